@@ -0,0 +1,168 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+
+	"github.com/apid/apid-core"
+)
+
+// Admin routes are diagnostics and operations endpoints. They're served on the api_admin_listen
+// listener if configured (otherwise on the api listener), and require the api_admin_auth_token bearer
+// token. Without a token they aren't served (404), unless api_admin_insecure is set.
+
+const (
+	configAdminAuthToken     = "api_admin_auth_token"
+	configAdminInsecure      = "api_admin_insecure"
+	configConfigDumpPath     = "api_config_dump_path"
+	configPprofPath          = "api_pprof_path"
+	configPprofBlockRate     = "api_pprof_block_rate"
+	configPprofMutexFraction = "api_pprof_mutex_fraction"
+
+	adminPrincipal = "admin"
+	redacted       = "<redacted>"
+)
+
+func (s *service) HandleAdmin(path string, handler http.Handler) apid.Route {
+	return s.admin.Handle(path, adminAuth(handler, true))
+}
+
+func (s *service) HandleAdminFunc(path string, handlerFunc http.HandlerFunc) apid.Route {
+	return s.admin.Handle(path, adminAuth(handlerFunc, true))
+}
+
+// mounts the built-in admin routes
+func (s *service) initAdmin() {
+	s.adminOnce.Do(func() {
+		s.InitExpVar()
+		s.initPprof()
+		if path := config.GetString(configConfigDumpPath); path != "" {
+			log.Infof("config dump available on path: %s", path)
+			s.HandleAdminFunc(path, configDumpHandler).Methods("GET")
+		}
+	})
+}
+
+// mounts net/http/pprof profiles and a goroutine dump under api_pprof_path, eg. "/debug/pprof":
+// <path>/ (index), <path>/profile (CPU), <path>/trace, <path>/heap, <path>/goroutine, <path>/block,
+// <path>/mutex, ... and <path>/goroutines (full dump of all goroutine stacks)
+func (s *service) initPprof() {
+	path := strings.TrimSuffix(config.GetString(configPprofPath), "/")
+	if path == "" {
+		return
+	}
+	log.Infof("pprof available on path: %s", path)
+
+	// block and mutex profiles are empty unless sampling is enabled
+	if rate := config.GetInt(configPprofBlockRate); rate > 0 {
+		runtime.SetBlockProfileRate(rate)
+	}
+	if fraction := config.GetInt(configPprofMutexFraction); fraction > 0 {
+		runtime.SetMutexProfileFraction(fraction)
+	}
+
+	s.HandleAdminFunc(path+"/", pprofIndex(path))
+	s.HandleAdminFunc(path+"/cmdline", pprof.Cmdline)
+	s.HandleAdminFunc(path+"/symbol", pprof.Symbol)
+	// CPU profile and trace run for the requested number of seconds
+	s.HandleAdminFunc(path+"/profile", pprof.Profile).WriteTimeout(0)
+	s.HandleAdminFunc(path+"/trace", pprof.Trace).WriteTimeout(0)
+	for _, name := range []string{"allocs", "block", "goroutine", "heap", "mutex", "threadcreate"} {
+		s.HandleAdmin(path+"/"+name, pprof.Handler(name))
+	}
+	s.HandleAdminFunc(path+"/goroutines", goroutineDumpHandler)
+}
+
+// pprof.Index only knows the /debug/pprof/ prefix
+func pprofIndex(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = "/debug/pprof/" + strings.TrimPrefix(r.URL.Path, path+"/")
+		pprof.Index(w, r)
+	}
+}
+
+func goroutineDumpHandler(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf)
+}
+
+type configValue struct {
+	Value  interface{}       `json:"value"`
+	Source apid.ConfigSource `json:"source"`
+	File   string            `json:"file,omitempty"`
+}
+
+// writes the effective config as JSON:
+// {"<key>": {"value": <value>, "source": "default|file|env|set", "file": "<config file>"}, ...}
+func configDumpHandler(w http.ResponseWriter, r *http.Request) {
+	dump := make(map[string]configValue)
+	for key, value := range config.AllSettings() {
+		if config.IsSecret(key) && value != nil && value != "" {
+			value = redacted
+		} else if _, err := json.Marshal(value); err != nil {
+			// eg. nested maps from YAML
+			value = fmt.Sprint(value)
+		}
+		dump[key] = configValue{Value: value, Source: config.Source(key), File: config.SourceFile(key)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dump); err != nil {
+		apid.LogWithContext(r.Context(), log).Errorf("unable to write config dump: %v", err)
+	}
+}
+
+// requires "Authorization: Bearer <api_admin_auth_token>" if the token is configured, and if failClosed
+// doesn't serve the route without a token, on any listener
+func adminAuth(handler http.Handler, failClosed bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := config.GetString(configAdminAuthToken)
+		if token == "" && failClosed && !config.GetBool(configAdminInsecure) {
+			apid.LogWithContext(r.Context(), log).Warnf("admin route %s requires %s or %s",
+				r.URL.Path, configAdminAuthToken, configAdminInsecure)
+			http.NotFound(w, r)
+			return
+		}
+		if token != "" {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+				apid.LogWithContext(r.Context(), log).Warnf("unauthorized admin request: %s", r.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="apid admin"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			r = withPrincipal(r, adminPrincipal)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -18,11 +18,14 @@ import (
 	"expvar"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
 	"net"
 
 	"github.com/apid/apid-core"
-	"github.com/apid/goscaffold"
+	"github.com/apid/apid-core/util"
 	"github.com/gorilla/mux"
 )
 
@@ -33,14 +36,212 @@ const (
 	configHealthPath        = "api_health"
 	configTlsKey            = "api_tls_key"
 	configTlsCert           = "api_tls_cert"
+	configAdminListen       = "api_admin_listen"
 	ConfigDBMaxConns        = "db_config_max_conns"
 	ConfigDBIdleConns       = "db_config_idle_conns"
 	ConfigDBConnsTimeout    = "db_config_conns_timeout_seconds"
 	dbDefaultMaxConnsLimit  = 1000
 	dbDefaultIdleConnsLimit = 1000
 	dbMaxConnTimeoutLimit   = 120
+	maxRequestIDLength      = 128
 )
 
+var configKeys = []apid.ConfigKey{
+	{
+		Key:         configAPIListen,
+		Type:        apid.ConfigTypeString,
+		Default:     "127.0.0.1:9000",
+		Description: "host:port of the api listener",
+	},
+	{
+		Key:         configAdminListen,
+		Type:        apid.ConfigTypeString,
+		Description: "host:port of the admin listener, admin routes are served on the api listener if not set",
+	},
+	{
+		Key:         configTlsKey,
+		Type:        apid.ConfigTypeString,
+		Description: "TLS key file, serves https if set with api_tls_cert",
+		Secret:      true,
+	},
+	{
+		Key:         configTlsCert,
+		Type:        apid.ConfigTypeString,
+		Description: "TLS certificate file",
+	},
+	{
+		Key:         configReadyPath,
+		Type:        apid.ConfigTypeString,
+		Default:     "/ready",
+		Description: "readiness path, 503 while shutting down",
+	},
+	{
+		Key:         configHealthPath,
+		Type:        apid.ConfigTypeString,
+		Default:     "/health",
+		Description: "health path",
+	},
+	{
+		Key:         configExpVarPath,
+		Type:        apid.ConfigTypeString,
+		Description: "admin path of the expvar variables",
+	},
+	{
+		Key:         ConfigDBMaxConns,
+		Type:        apid.ConfigTypeInt,
+		Default:     dbDefaultMaxConnsLimit,
+		Description: "max open connections per DB",
+		Min:         0,
+	},
+	{
+		Key:         ConfigDBIdleConns,
+		Type:        apid.ConfigTypeInt,
+		Default:     dbDefaultIdleConnsLimit,
+		Description: "max idle connections per DB",
+		Min:         0,
+	},
+	{
+		Key:         ConfigDBConnsTimeout,
+		Type:        apid.ConfigTypeInt,
+		Default:     dbMaxConnTimeoutLimit,
+		Description: "max lifetime of DB connections in seconds",
+		Min:         0,
+	},
+	{
+		Key:         configReadTimeout,
+		Type:        apid.ConfigTypeDuration,
+		Description: "max duration to read a request, 0 for none",
+		Min:         0,
+	},
+	{
+		Key:         configReadHeaderTimeout,
+		Type:        apid.ConfigTypeDuration,
+		Default:     defaultReadHeaderTimeout,
+		Description: "max duration to read request headers",
+		Min:         0,
+	},
+	{
+		Key:         configWriteTimeout,
+		Type:        apid.ConfigTypeDuration,
+		Description: "max duration to write a response, 0 for none",
+		Min:         0,
+	},
+	{
+		Key:         configIdleTimeout,
+		Type:        apid.ConfigTypeDuration,
+		Default:     defaultIdleTimeout,
+		Description: "max keep-alive idle duration",
+		Min:         0,
+	},
+	{
+		Key:         configMaxHeaderBytes,
+		Type:        apid.ConfigTypeInt,
+		Default:     http.DefaultMaxHeaderBytes,
+		Description: "max size of request headers",
+		Min:         0,
+	},
+	{
+		Key:         configHTTP2,
+		Type:        apid.ConfigTypeBool,
+		Default:     true,
+		Description: "enable HTTP/2 over TLS",
+	},
+	{
+		Key:         configH2C,
+		Type:        apid.ConfigTypeBool,
+		Default:     false,
+		Description: "accept cleartext HTTP/2 on a plaintext listener",
+	},
+	{
+		Key:         configShutdownTimeout,
+		Type:        apid.ConfigTypeDuration,
+		Default:     defaultShutdownTimeout,
+		Description: "max duration of graceful shutdown",
+		Min:         0,
+	},
+	{
+		Key:         configMaxBodySize,
+		Type:        apid.ConfigTypeSize,
+		Default:     defaultMaxBodySize,
+		Description: "max request body size, eg. 10MB, 0 for no limit",
+	},
+	{
+		Key:         configMinBodyReadRate,
+		Type:        apid.ConfigTypeInt,
+		Default:     defaultMinBodyReadRate,
+		Description: "min request body rate in bytes/sec, 0 for none",
+		Min:         0,
+	},
+	{
+		Key:         configMinBodyReadRateWait,
+		Type:        apid.ConfigTypeDuration,
+		Default:     defaultMinBodyReadRateWait,
+		Description: "grace period before the min body rate applies",
+		Min:         0,
+	},
+	{
+		Key:         configStreamHeartbeat,
+		Type:        apid.ConfigTypeDuration,
+		Default:     defaultStreamHeartbeat,
+		Description: "interval of stream heartbeats",
+		Min:         0,
+	},
+	{
+		Key:         configStreamClientQueue,
+		Type:        apid.ConfigTypeInt,
+		Default:     defaultStreamClientQueue,
+		Description: "events buffered per stream client",
+		Min:         1,
+	},
+	{
+		Key:         configStreamHistorySize,
+		Type:        apid.ConfigTypeInt,
+		Default:     defaultStreamHistorySize,
+		Description: "events kept for resuming streams",
+		Min:         0,
+	},
+	{
+		Key:         configStreamWriteWait,
+		Type:        apid.ConfigTypeDuration,
+		Default:     defaultStreamWriteWait,
+		Description: "max duration of a stream write",
+		Min:         0,
+	},
+	{
+		Key:         configAdminAuthToken,
+		Type:        apid.ConfigTypeString,
+		Description: "bearer token required by admin routes",
+		Secret:      true,
+	},
+	{
+		Key:         configAdminInsecure,
+		Type:        apid.ConfigTypeBool,
+		Description: "serve admin routes without a token, eg. for local development",
+	},
+	{
+		Key:         configConfigDumpPath,
+		Type:        apid.ConfigTypeString,
+		Description: "admin path of the effective config, secrets redacted",
+	},
+	{
+		Key:         configPprofPath,
+		Type:        apid.ConfigTypeString,
+		Description: "admin path of the pprof profiles, eg. /debug/pprof",
+	},
+	{
+		Key:         configPprofBlockRate,
+		Type:        apid.ConfigTypeInt,
+		Description: "block profile rate, see runtime.SetBlockProfileRate",
+		Min:         0,
+	},
+	{
+		Key:         configPprofMutexFraction,
+		Type:        apid.ConfigTypeInt,
+		Description: "mutex profile fraction, see runtime.SetMutexProfileFraction",
+		Min:         0,
+	},
+}
+
 var log apid.LogService
 var config apid.ConfigService
 var requests *expvar.Map = expvar.NewMap("requests")
@@ -49,98 +250,126 @@ func CreateService() apid.APIService {
 	config = apid.Config()
 	log = apid.Log().ForModule("api")
 
-	config.SetDefault(configAPIListen, "127.0.0.1:9000")
-	config.SetDefault(configReadyPath, "/ready")
-	config.SetDefault(configHealthPath, "/health")
+	config.Register(configKeys...)
+
+	addr := listenAddress(configAPIListen)
+	log.Infof("will open api port bound to %s", addr)
+
+	r := mux.NewRouter()
+	rw := &router{r}
+	srv := configureServer("api", addr, rw)
+
+	s := &service{router: rw, server: srv, admin: rw}
+
+	// admin routes (expvar, pprof, ...) are served on their own listener if configured
+	if config.GetString(configAdminListen) != "" {
+		adminAddr := listenAddress(configAdminListen)
+		log.Infof("will open admin port bound to %s", adminAddr)
+		s.admin = &router{mux.NewRouter()}
+		s.adminServer = configureServer("admin", adminAddr, s.admin)
+	}
 
-	config.SetDefault(ConfigDBMaxConns, dbDefaultMaxConnsLimit)
-	config.SetDefault(ConfigDBIdleConns, dbDefaultIdleConnsLimit)
-	config.SetDefault(ConfigDBConnsTimeout, dbMaxConnTimeoutLimit)
+	return s
+}
 
-	listen := config.GetString(configAPIListen)
+// resolves the host:port to listen on from the config key
+func listenAddress(configKey string) string {
+	listen := config.GetString(configKey)
 	h, p, err := net.SplitHostPort(listen)
 	if err != nil {
-		log.Panicf("%s config: err parsing '%s': %v", configAPIListen, listen, err)
+		log.Panicf("%s config: err parsing '%s': %v", configKey, listen, err)
 	}
 	var ip net.IP
 	if h != "" {
 		ips, err := net.LookupIP(h)
 		if err != nil {
-			log.Panicf("%s config: unable to resolve IP for '%s': %v", configAPIListen, listen, err)
+			log.Panicf("%s config: unable to resolve IP for '%s': %v", configKey, listen, err)
 		}
 		ip = ips[0]
 	}
 	port, err := net.LookupPort("tcp", p)
 	if err != nil {
-		log.Panicf("%s config: unable to resolve port for '%s': %v", configAPIListen, listen, err)
+		log.Panicf("%s config: unable to resolve port for '%s': %v", configKey, listen, err)
 	}
 
-	log.Infof("will open api port %d bound to %s", port, ip)
-
-	r := mux.NewRouter()
-	rw := &router{r}
-	scaffold := goscaffold.CreateHTTPScaffold()
+	host := ""
 	if ip != nil {
-		scaffold.SetlocalBindIPAddressV4(ip)
+		host = ip.String()
 	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func configureServer(name, addr string, handler http.Handler) *server {
+	srv := newServer(name, addr, handler)
 
 	// listen on https
 	if key, cert := config.GetString(configTlsKey), config.GetString(configTlsCert); key != "" && cert != "" {
 		log.Infof("Load TLS key: %v, TLS cert: %v", key, cert)
-		scaffold.SetSecurePort(port)
-		scaffold.SetKeyFile(key)
-		scaffold.SetCertFile(cert)
-	} else { // listen on http
-		scaffold.SetInsecurePort(port)
+		if err := srv.setTLS(key, cert); err != nil {
+			log.Panicf("unable to configure HTTP/2: %v", err)
+		}
+	} else if config.GetBool(configH2C) { // listen on http, accepting cleartext HTTP/2
+		log.Infof("h2c enabled on %s port %s", name, addr)
+		srv.setH2C()
 	}
 
-	scaffold.CatchSignals()
+	srv.catchSignals()
 
 	// Set an URL that may be used by a load balancer to test if the server is ready to handle requests
-	if config.GetString(configReadyPath) != "" {
-		scaffold.SetReadyPath(config.GetString(configReadyPath))
-	}
+	srv.readyPath = config.GetString(configReadyPath)
 
 	// Set an URL that may be used by infrastructure to test
 	// if the server is working or if it needs to be restarted or replaced
-	if config.GetString(configHealthPath) != "" {
-		scaffold.SetHealthPath(config.GetString(configHealthPath))
-	}
+	srv.healthPath = config.GetString(configHealthPath)
 
-	return &service{rw, scaffold}
+	return srv
 }
 
 type service struct {
 	*router
-	scaffold *goscaffold.HTTPScaffold
+	server      *server
+	admin       *router
+	adminServer *server
+	adminOnce   sync.Once
 }
 
 func (s *service) Listen() error {
-	err := s.scaffold.StartListen(s.r)
+	s.initAdmin()
+	if s.adminServer != nil {
+		if err := s.adminServer.start(); err != nil {
+			return err
+		}
+		defer s.adminServer.shutdown(nil)
+	}
+
+	err := s.server.start()
 	if err != nil {
 		return err
 	}
 
 	apid.Events().Emit(apid.SystemEventsSelector, apid.APIListeningEvent)
 
-	return s.scaffold.WaitForShutdown()
+	return s.server.waitForShutdown()
 }
 
 func (s *service) Close() {
-	s.scaffold.Shutdown(nil)
-	s.scaffold = nil
+	s.server.shutdown(nil)
+	if s.adminServer != nil {
+		s.adminServer.shutdown(nil)
+	}
 }
 
 func (s *service) InitExpVar() {
 	if config.IsSet(configExpVarPath) {
 		log.Infof("expvar available on path: %s", config.Get(configExpVarPath))
-		s.HandleFunc(config.GetString(configExpVarPath), expvarHandler)
+		// served without a token on the api listener, as before admin routes
+		s.admin.Handle(config.GetString(configExpVarPath), adminAuth(http.HandlerFunc(expvarHandler), false))
 	}
 }
 
 // for testing
 func (s *service) Router() apid.Router {
-	s.InitExpVar()
+	s.initAdmin()
 	return s
 }
 
@@ -148,6 +377,55 @@ func (s *service) Vars(r *http.Request) map[string]string {
 	return mux.Vars(r)
 }
 
+func (s *service) RequestID(r *http.Request) string {
+	return apid.RequestIDFromContext(r.Context())
+}
+
+func (s *service) RequestLog(r *http.Request) apid.LogService {
+	return apid.LogFromContext(r.Context())
+}
+
+func (s *service) Principal(r *http.Request) string {
+	return apid.PrincipalFromContext(r.Context())
+}
+
+func (s *service) WithPrincipal(r *http.Request, principal string) *http.Request {
+	return withPrincipal(r, principal)
+}
+
+func withPrincipal(r *http.Request, principal string) *http.Request {
+	ctx := apid.ContextWithPrincipal(r.Context(), principal)
+	ctx = apid.ContextWithLogger(ctx, apid.LogFromContext(r.Context()).WithField(apid.PrincipalField, principal))
+	return r.WithContext(ctx)
+}
+
+// attaches the request ID and a request logger to the request context.
+// an incoming X-Request-ID is honored if sane, otherwise a new ID is generated.
+// the ID is echoed back in the X-Request-ID response header.
+func withRequestContext(w http.ResponseWriter, req *http.Request) *http.Request {
+	id := req.Header.Get(apid.RequestIDHeader)
+	if !validRequestID(id) {
+		id = util.GenerateUUID()
+	}
+	w.Header().Set(apid.RequestIDHeader, id)
+	ctx := apid.ContextWithRequestID(req.Context(), id)
+	ctx = apid.ContextWithLogger(ctx, apid.Log().WithField(apid.RequestIDField, id))
+	return req.WithContext(ctx)
+}
+
+// don't let clients inject arbitrary content into logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 func expvarHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	fmt.Fprint(w, "{\n")
@@ -168,24 +446,44 @@ type router struct {
 
 func (r *router) Handle(path string, handler http.Handler) apid.Route {
 	log.Infof("Handle %s: %v", path, handler)
-	return &route{r.r.Handle(path, handler)}
+	rt := &route{maxBodySize: useDefaultBodySize, writeTimeout: useDefaultWriteTimeout}
+	rt.r = r.r.Handle(path, rt.guardWrite(rt.guardBody(handler)))
+	return rt
 }
 
 func (r *router) HandleFunc(path string, handlerFunc http.HandlerFunc) apid.Route {
 	log.Infof("Handle %s: %v", path, handlerFunc)
-	return &route{r.r.HandleFunc(path, handlerFunc)}
+	rt := &route{maxBodySize: useDefaultBodySize, writeTimeout: useDefaultWriteTimeout}
+	rt.r = r.r.Handle(path, rt.guardWrite(rt.guardBody(handlerFunc)))
+	return rt
 }
 
 func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	requests.Add(req.URL.Path, 1)
-	log.Infof("Handling %s", req.URL.Path)
+	req = withRequestContext(w, req)
+	apid.LogWithContext(req.Context(), log).Infof("Handling %s", req.URL.Path)
 	r.r.ServeHTTP(w, req)
 }
 
 type route struct {
-	r *mux.Route
+	r            *mux.Route
+	maxBodySize  int64
+	writeTimeout time.Duration
 }
 
 func (r *route) Methods(methods ...string) apid.Route {
-	return &route{r.r.Methods(methods...)}
+	r.r.Methods(methods...)
+	return r
+}
+
+// overrides the api_max_body_size for this route
+func (r *route) MaxBodySize(bytes int64) apid.Route {
+	r.maxBodySize = bytes
+	return r
+}
+
+// overrides the api_write_timeout for this route, eg. to allow long polling
+func (r *route) WriteTimeout(timeout time.Duration) apid.Route {
+	r.writeTimeout = timeout
+	return r
 }
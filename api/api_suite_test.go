@@ -37,8 +37,10 @@ var _ = BeforeSuite(func() {
 	apid.Initialize(factory.DefaultServicesFactory())
 
 	apid.Config().Set("api_expvar_path", "/exp/vars")
+	apid.Config().Set("api_pprof_path", "/debug/pprof")
+	apid.Config().Set("api_config_dump_path", "/debug/config")
 
-	// get the router - this will have the /exp/vars route registered
+	// get the router - this will have the /exp/vars, /debug/pprof and /debug/config routes registered
 	router := apid.API().Router()
 
 	// create our test server
@@ -15,12 +15,22 @@
 package api_test
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/api"
+	"github.com/apid/apid-core/util"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"time"
 )
 
 var _ = Describe("API Service", func() {
@@ -44,4 +54,272 @@ var _ = Describe("API Service", func() {
 		requests := m["requests"].(map[string]interface{})
 		Expect(requests["/exp/vars"]).Should(Equal(float64(1)))
 	})
+
+	Context("request context", func() {
+		var seenID, seenPrincipal string
+
+		BeforeEach(func() {
+			seenID, seenPrincipal = "", ""
+		})
+
+		handle := func(path string) string {
+			uri, err := url.Parse(testServer.URL)
+			Expect(err).NotTo(HaveOccurred())
+			uri.Path = path
+			apid.API().HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+				r = apid.API().WithPrincipal(r, "tester")
+				seenID = apid.API().RequestID(r)
+				seenPrincipal = apid.API().Principal(r)
+				Expect(apid.API().RequestLog(r)).NotTo(BeNil())
+				Expect(apid.RequestIDFromContext(r.Context())).To(Equal(seenID))
+			})
+			return uri.String()
+		}
+
+		It("should honor an incoming X-Request-ID", func() {
+			req, err := http.NewRequest("GET", handle("/reqid/honor"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set(apid.RequestIDHeader, "abc-123")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.Header.Get(apid.RequestIDHeader)).To(Equal("abc-123"))
+			Expect(seenID).To(Equal("abc-123"))
+			Expect(seenPrincipal).To(Equal("tester"))
+		})
+
+		It("should generate a request ID if missing or invalid", func() {
+			req, err := http.NewRequest("GET", handle("/reqid/generate"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set(apid.RequestIDHeader, "bad\tid")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(util.IsValidUUID(seenID)).To(BeTrue())
+			Expect(resp.Header.Get(apid.RequestIDHeader)).To(Equal(seenID))
+		})
+	})
+
+	Context("server", func() {
+
+		It("should let a route exceed the server write timeout", func() {
+			router := apid.API().Router()
+			slow := func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(300 * time.Millisecond)
+				w.Write([]byte("done"))
+			}
+			router.HandleFunc("/timeout/default", slow)
+			router.HandleFunc("/timeout/long", slow).WriteTimeout(time.Second)
+			router.HandleFunc("/timeout/none", slow).WriteTimeout(0)
+
+			server := httptest.NewUnstartedServer(router)
+			server.Config.WriteTimeout = 100 * time.Millisecond
+			server.Start()
+			defer server.Close()
+
+			_, err := http.Get(server.URL + "/timeout/default")
+			Expect(err).To(HaveOccurred())
+
+			for _, path := range []string{"/timeout/long", "/timeout/none"} {
+				resp, err := http.Get(server.URL + path)
+				Expect(err).NotTo(HaveOccurred())
+				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(body)).To(Equal("done"))
+			}
+		}, 3)
+
+		It("should serve cleartext HTTP/2 when h2c is enabled", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			addr := ln.Addr().String()
+			ln.Close()
+
+			apid.Config().Set("api_listen", addr)
+			apid.Config().Set("api_h2c", true)
+			defer apid.Config().Set("api_h2c", false)
+			svc := api.CreateService()
+			go svc.Listen()
+			defer svc.(interface {
+				Close()
+			}).Close()
+
+			client := &http.Client{Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			}}
+			Eventually(func() error {
+				resp, err := client.Get("http://" + addr + "/ready")
+				if err == nil {
+					defer resp.Body.Close()
+					Expect(resp.ProtoMajor).To(Equal(2))
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				}
+				return err
+			}).Should(Succeed())
+		}, 3)
+	})
+
+	Context("request body", func() {
+
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			router := apid.API().Router()
+			readAll := func(w http.ResponseWriter, r *http.Request) {
+				if _, err := ioutil.ReadAll(r.Body); err != nil {
+					if _, ok := err.(*http.MaxBytesError); ok {
+						w.WriteHeader(http.StatusRequestEntityTooLarge)
+						return
+					}
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			}
+			router.HandleFunc("/body/default", readAll)
+			router.HandleFunc("/body/small", readAll).MaxBodySize(10)
+			// as most handlers, fails with 400 whatever the error
+			router.HandleFunc("/body/bad", func(w http.ResponseWriter, r *http.Request) {
+				if _, err := ioutil.ReadAll(r.Body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+			}).MaxBodySize(10)
+			server = httptest.NewServer(router)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		post := func(path string, body io.Reader) int {
+			resp, err := http.Post(server.URL+path, "text/plain", body)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		It("should reject bodies over the route limit with 413", func() {
+			Expect(post("/body/small", strings.NewReader("0123456789"))).To(Equal(http.StatusOK))
+			Expect(post("/body/small", strings.NewReader("0123456789A"))).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(post("/body/default", strings.NewReader("0123456789A"))).To(Equal(http.StatusOK))
+		})
+
+		It("should limit bodies to api_max_body_size", func() {
+			apid.Config().Set("api_max_body_size", "1kb")
+			defer apid.Config().Set("api_max_body_size", 0)
+
+			Expect(post("/body/default", strings.NewReader(strings.Repeat("x", 1024)))).To(Equal(http.StatusOK))
+			Expect(post("/body/default", strings.NewReader(strings.Repeat("x", 1025)))).
+				To(Equal(http.StatusRequestEntityTooLarge))
+			// the route limit wins
+			Expect(post("/body/small", strings.NewReader("0123456789A"))).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+
+		It("should limit chunked bodies", func() {
+			// io.MultiReader hides the length, so the body is sent chunked
+			body := io.MultiReader(strings.NewReader("0123456789A"))
+			Expect(post("/body/small", body)).To(Equal(http.StatusRequestEntityTooLarge))
+			body = io.MultiReader(strings.NewReader("0123456789A"))
+			Expect(post("/body/bad", body)).To(Equal(http.StatusRequestEntityTooLarge))
+			body = io.MultiReader(strings.NewReader("0123456789"))
+			Expect(post("/body/bad", body)).To(Equal(http.StatusOK))
+		})
+
+		It("should fail bodies sent below the minimum rate", func() {
+			apid.Config().Set("api_min_body_read_rate", 1000)
+			apid.Config().Set("api_min_body_read_rate_grace", "100ms")
+			defer apid.Config().Set("api_min_body_read_rate", 1024)
+			defer apid.Config().Set("api_min_body_read_rate_grace", "10s")
+
+			pr, pw := io.Pipe()
+			go func() {
+				pw.Write([]byte("slow"))
+				time.Sleep(time.Second)
+				pw.Close()
+			}()
+			Expect(post("/body/default", pr)).To(Equal(http.StatusBadRequest))
+		}, 3)
+	})
+
+	Context("admin", func() {
+
+		get := func(path, token string) (int, string) {
+			req, err := http.NewRequest("GET", testServer.URL+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return resp.StatusCode, string(body)
+		}
+
+		It("should serve pprof profiles and a goroutine dump", func() {
+			apid.Config().Set("api_admin_auth_token", "secret")
+			defer apid.Config().Set("api_admin_auth_token", "")
+
+			code, body := get("/debug/pprof/", "secret")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("heap"))
+
+			code, _ = get("/debug/pprof/heap", "secret")
+			Expect(code).To(Equal(http.StatusOK))
+
+			code, body = get("/debug/pprof/goroutines", "secret")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("goroutine "))
+		})
+
+		It("should require the admin token if configured", func() {
+			apid.Config().Set("api_admin_auth_token", "secret")
+			defer apid.Config().Set("api_admin_auth_token", "")
+
+			code, _ := get("/debug/pprof/goroutines", "")
+			Expect(code).To(Equal(http.StatusUnauthorized))
+			code, _ = get("/debug/pprof/goroutines", "wrong")
+			Expect(code).To(Equal(http.StatusUnauthorized))
+			code, _ = get("/debug/pprof/goroutines", "secret")
+			Expect(code).To(Equal(http.StatusOK))
+		})
+
+		It("should not serve admin routes without a token", func() {
+			code, _ := get("/debug/pprof/cmdline", "")
+			Expect(code).To(Equal(http.StatusNotFound))
+			code, _ = get("/debug/config", "")
+			Expect(code).To(Equal(http.StatusNotFound))
+
+			apid.Config().Set("api_admin_insecure", true)
+			defer apid.Config().Set("api_admin_insecure", false)
+			code, _ = get("/debug/pprof/cmdline", "")
+			Expect(code).To(Equal(http.StatusOK))
+		})
+
+		It("should dump the config with its sources and secrets redacted", func() {
+			apid.Config().Set("api_admin_auth_token", "secret")
+			defer apid.Config().Set("api_admin_auth_token", "")
+			apid.Config().Set("configfwdproxy_passwd", "hunter2")
+			defer apid.Config().Set("configfwdproxy_passwd", "")
+
+			code, body := get("/debug/config", "secret")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).NotTo(ContainSubstring("hunter2"))
+			Expect(body).NotTo(ContainSubstring(`"secret"`))
+
+			var dump map[string]struct {
+				Value  interface{}
+				Source string
+			}
+			Expect(json.Unmarshal([]byte(body), &dump)).To(Succeed())
+			Expect(dump["configfwdproxy_passwd"].Value).To(Equal("<redacted>"))
+			Expect(dump["api_admin_auth_token"].Value).To(Equal("<redacted>"))
+			Expect(dump["api_health"].Source).To(Equal("default"))
+			Expect(dump["api_config_dump_path"].Value).To(Equal("/debug/config"))
+			Expect(dump["api_config_dump_path"].Source).To(Equal("set"))
+		})
+	})
 })
@@ -0,0 +1,183 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/apid/apid-core"
+)
+
+const (
+	configMaxBodySize         = "api_max_body_size"
+	configMinBodyReadRate     = "api_min_body_read_rate"
+	configMinBodyReadRateWait = "api_min_body_read_rate_grace"
+
+	defaultMaxBodySize         = 0    // no limit
+	defaultMinBodyReadRate     = 1024 // bytes per second
+	defaultMinBodyReadRateWait = 10 * time.Second
+
+	useDefaultBodySize = -1
+)
+
+// limits the request body of the route's requests:
+// requests declaring a Content-Length over the limit are rejected with 413. Other bodies, eg. chunked, fail reading
+// with *http.MaxBytesError past the limit, and are answered with 413 unless the handler has already responded.
+// Bodies must also be sent at a minimum rate, see minRateBody.
+func (r *route) guardBody(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Body == nil || req.Body == http.NoBody {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		limit := r.maxBodySize
+		if limit == useDefaultBodySize {
+			limit = int64(config.GetSizeInBytes(configMaxBodySize))
+		}
+		if limit > 0 {
+			if req.ContentLength > limit {
+				apid.LogWithContext(req.Context(), log).Warnf("request body of %d bytes exceeds limit of %d bytes",
+					req.ContentLength, limit)
+				bodyTooLarge(w, limit)
+				return
+			}
+			lw := &limitWriter{ResponseWriter: w, req: req, limit: limit}
+			req.Body = &limitBody{http.MaxBytesReader(w, req.Body, limit), lw}
+			w = lw
+		}
+
+		if rate := config.GetInt(configMinBodyReadRate); rate > 0 {
+			req.Body = &minRateBody{
+				ReadCloser: req.Body,
+				rc:         http.NewResponseController(w),
+				req:        req,
+				rate:       int64(rate),
+				start:      time.Now().Add(config.GetDuration(configMinBodyReadRateWait)),
+			}
+		}
+
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func bodyTooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, "request body too large, limit is "+strconv.FormatInt(limit, 10)+" bytes",
+		http.StatusRequestEntityTooLarge)
+}
+
+// answers 413 when the body exceeds the limit, unless the handler has already responded.
+// the handler's response is then discarded.
+type limitWriter struct {
+	http.ResponseWriter
+	req      *http.Request
+	limit    int64
+	wrote    bool
+	rejected bool
+}
+
+func (w *limitWriter) WriteHeader(code int) {
+	if w.rejected {
+		return
+	}
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *limitWriter) Write(b []byte) (int, error) {
+	if w.rejected {
+		return len(b), nil
+	}
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *limitWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.rejected {
+		w.wrote = true
+		f.Flush()
+	}
+}
+
+// for http.ResponseController
+func (w *limitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *limitWriter) reject() {
+	if w.wrote || w.rejected {
+		return
+	}
+	w.rejected = true
+	apid.LogWithContext(w.req.Context(), log).Warnf("request body exceeds limit of %d bytes", w.limit)
+	bodyTooLarge(w.ResponseWriter, w.limit)
+}
+
+type limitBody struct {
+	io.ReadCloser
+	w *limitWriter
+}
+
+func (b *limitBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if _, ok := err.(*http.MaxBytesError); ok {
+		b.w.reject()
+	}
+	return
+}
+
+// protects against slowloris-style clients trickling the request body:
+// after a grace period, the client must have sent the body at an average rate of at least `rate` bytes/sec.
+// enforced by moving the connection's read deadline ahead of each read.
+type minRateBody struct {
+	io.ReadCloser
+	rc     *http.ResponseController
+	req    *http.Request
+	rate   int64
+	start  time.Time
+	read   int64
+	warned bool
+}
+
+func (b *minRateBody) Read(p []byte) (n int, err error) {
+	// deadline for the next byte to arrive
+	deadline := b.start.Add(time.Duration(float64(b.read+1) / float64(b.rate) * float64(time.Second)))
+	b.setReadDeadline(deadline)
+	n, err = b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err == io.EOF {
+		b.setReadDeadline(time.Time{})
+	} else if err != nil && time.Now().After(deadline) {
+		apid.LogWithContext(b.req.Context(), log).Warnf("request body read below minimum rate of %d bytes/sec: %v",
+			b.rate, err)
+	}
+	return
+}
+
+func (b *minRateBody) Close() error {
+	b.setReadDeadline(time.Time{})
+	return b.ReadCloser.Close()
+}
+
+// the deadline must not outlive the body: the server keeps reading the connection in the background
+func (b *minRateBody) setReadDeadline(deadline time.Time) {
+	if err := b.rc.SetReadDeadline(deadline); err != nil && err != http.ErrNotSupported && !b.warned {
+		b.warned = true
+		apid.LogWithContext(b.req.Context(), log).Warnf("unable to set read deadline: %v", err)
+	}
+}
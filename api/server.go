@@ -0,0 +1,202 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/apid/apid-core"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	configReadTimeout       = "api_read_timeout"
+	configReadHeaderTimeout = "api_read_header_timeout"
+	configWriteTimeout      = "api_write_timeout"
+	configIdleTimeout       = "api_idle_timeout"
+	configMaxHeaderBytes    = "api_max_header_bytes"
+	configHTTP2             = "api_http2"
+	configH2C               = "api_h2c"
+	configShutdownTimeout   = "api_shutdown_timeout"
+
+	defaultReadHeaderTimeout = 30 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultShutdownTimeout   = 10 * time.Second
+
+	useDefaultWriteTimeout = -1
+)
+
+// server wraps an http.Server configured from the api_* config keys.
+// It also answers the ready and health paths, and shuts down gracefully on SIGINT/SIGTERM.
+type server struct {
+	*http.Server
+	name            string
+	handler         http.Handler
+	keyFile         string
+	certFile        string
+	readyPath       string
+	healthPath      string
+	shutdownTimeout time.Duration
+	shuttingDown    int32
+	shutdownOnce    sync.Once
+	stopped         chan struct{}
+	done            chan error
+}
+
+func newServer(name, addr string, handler http.Handler) *server {
+	s := &server{
+		name:            name,
+		handler:         handler,
+		shutdownTimeout: config.GetDuration(configShutdownTimeout),
+		stopped:         make(chan struct{}),
+		done:            make(chan error, 1),
+	}
+	s.Server = &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadTimeout:       config.GetDuration(configReadTimeout),
+		ReadHeaderTimeout: config.GetDuration(configReadHeaderTimeout),
+		WriteTimeout:      config.GetDuration(configWriteTimeout),
+		IdleTimeout:       config.GetDuration(configIdleTimeout),
+		MaxHeaderBytes:    config.GetInt(configMaxHeaderBytes),
+	}
+	return s
+}
+
+// listen on https
+func (s *server) setTLS(keyFile, certFile string) error {
+	s.keyFile, s.certFile = keyFile, certFile
+	if !config.GetBool(configHTTP2) {
+		// a non-nil, empty map disables HTTP/2
+		s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		return nil
+	}
+	return http2.ConfigureServer(s.Server, &http2.Server{IdleTimeout: s.IdleTimeout})
+}
+
+// serve cleartext HTTP/2 (h2c) next to HTTP/1.1 on a plaintext listener, eg. for internal sidecar traffic
+func (s *server) setH2C() {
+	s.Server.Handler = h2c.NewHandler(s, &http2.Server{IdleTimeout: s.IdleTimeout})
+}
+
+func (s *server) isTLS() bool {
+	return s.keyFile != "" && s.certFile != ""
+}
+
+// starts serving in the background
+func (s *server) start() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	log.Infof("%s listening on %s (tls: %t)", s.name, ln.Addr(), s.isTLS())
+	go func() {
+		var err error
+		if s.isTLS() {
+			err = s.ServeTLS(ln, s.certFile, s.keyFile)
+		} else {
+			err = s.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.shutdown(err)
+		}
+	}()
+	return nil
+}
+
+// stops accepting requests, reports not ready and waits for in-flight requests to complete.
+// reason is returned by waitForShutdown().
+func (s *server) shutdown(reason error) {
+	s.shutdownOnce.Do(func() {
+		atomic.StoreInt32(&s.shuttingDown, 1)
+		close(s.stopped)
+		ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Errorf("%s graceful shutdown failed: %v", s.name, err)
+		}
+		s.done <- reason
+	})
+}
+
+func (s *server) waitForShutdown() error {
+	err := <-s.done
+	s.done <- err
+	return err
+}
+
+func (s *server) catchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.Infof("%s caught signal %s, shutting down", s.name, sig)
+			s.shutdown(fmt.Errorf("caught signal %s", sig))
+		case <-s.stopped:
+		}
+	}()
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// lets a load balancer know to stop sending requests while shutting down
+	if s.readyPath != "" && r.URL.Path == s.readyPath {
+		if atomic.LoadInt32(&s.shuttingDown) != 0 {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if s.healthPath != "" && r.URL.Path == s.healthPath {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+// replaces the server write deadline with the route's WriteTimeout, if set. Handlers that write for longer,
+// eg. streams, extend it with setWriteDeadline.
+func (r *route) guardWrite(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.writeTimeout != useDefaultWriteTimeout {
+			setWriteDeadline(w, req, r.writeTimeout)
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// 0 timeout clears the deadline
+func setWriteDeadline(w http.ResponseWriter, req *http.Request, timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil && err != http.ErrNotSupported {
+		apid.LogWithContext(req.Context(), log).Warnf("unable to set write deadline: %v", err)
+	}
+}
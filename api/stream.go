@@ -0,0 +1,384 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apid/apid-core"
+	"github.com/gorilla/websocket"
+)
+
+// Streaming alternatives to util.LongPolling: instead of one notification per poll, every event is pushed
+// to connected clients as it arrives, over Server-Sent Events or a WebSocket.
+//
+// Each event is assigned an increasing ID, starting from the Streamer creation time in nanoseconds so IDs aren't
+// reused after a restart. The last events are retained so a reconnecting client can resume:
+// SSE clients send the standard "Last-Event-ID" header, WebSocket clients the "last_event_id" query parameter.
+// A client that can't keep up with the stream (its buffer is full) is disconnected and is expected to
+// reconnect and resume.
+
+const (
+	configStreamHeartbeat   = "api_stream_heartbeat_interval"
+	configStreamClientQueue = "api_stream_client_buffer_size"
+	configStreamHistorySize = "api_stream_history_size"
+	configStreamWriteWait   = "api_stream_write_timeout"
+
+	defaultStreamHeartbeat   = 15 * time.Second
+	defaultStreamClientQueue = 64
+	defaultStreamHistorySize = 256
+	defaultStreamWriteWait   = 10 * time.Second
+
+	lastEventIDHeader = "Last-Event-ID"
+	lastEventIDParam  = "last_event_id"
+)
+
+type streamEvent struct {
+	id   int64
+	data []byte
+}
+
+type streamClient struct {
+	events  chan streamEvent
+	dropped chan struct{}
+}
+
+// Streamer fans out events from a single source to any number of SSE and WebSocket clients
+type Streamer struct {
+	mu        sync.Mutex
+	lastID    int64
+	history   []streamEvent
+	clients   map[*streamClient]bool
+	closed    chan struct{}
+	stop      func()
+	heartbeat time.Duration
+	writeWait time.Duration
+	queueSize int
+	maxHist   int
+	upgrader  websocket.Upgrader
+}
+
+// NewEventsStreamer creates a Streamer that pushes every event emitted to selector
+func NewEventsStreamer(events apid.EventsService, selector apid.EventSelector) *Streamer {
+	s := newStreamer()
+	handler := &streamHandler{s}
+	events.Listen(selector, handler)
+	s.stop = func() {
+		events.StopListening(selector, handler)
+	}
+	return s
+}
+
+// NewDistributeStreamer creates a Streamer that pushes the elements distributed through
+// `go util.DistributeEvents(deliverChan, addSubscriber)`. DistributeEvents drops its subscribers once it delivers
+// an element, so elements delivered before the Streamer subscribes again are lost: use NewEventsStreamer when
+// every event must be pushed.
+func NewDistributeStreamer(addSubscriber chan chan interface{}) *Streamer {
+	s := newStreamer()
+	done := make(chan struct{})
+	go func() {
+		for {
+			notifyChan := make(chan interface{}, 1)
+			select {
+			case addSubscriber <- notifyChan:
+			case <-done:
+				return
+			}
+			select {
+			case element, ok := <-notifyChan:
+				if ok {
+					s.Publish(element)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	s.stop = func() {
+		close(done)
+	}
+	return s
+}
+
+func newStreamer() *Streamer {
+	heartbeat := config.GetDuration(configStreamHeartbeat)
+	if heartbeat <= 0 {
+		heartbeat = defaultStreamHeartbeat
+	}
+	writeWait := config.GetDuration(configStreamWriteWait)
+	if writeWait <= 0 {
+		writeWait = defaultStreamWriteWait
+	}
+	queueSize := config.GetInt(configStreamClientQueue)
+	if queueSize <= 0 {
+		queueSize = defaultStreamClientQueue
+	}
+	maxHist := config.GetInt(configStreamHistorySize)
+	if maxHist < 0 {
+		maxHist = 0
+	}
+	return &Streamer{
+		lastID:    time.Now().UnixNano(),
+		clients:   make(map[*streamClient]bool),
+		closed:    make(chan struct{}),
+		stop:      func() {},
+		heartbeat: heartbeat,
+		writeWait: writeWait,
+		queueSize: queueSize,
+		maxHist:   maxHist,
+	}
+}
+
+// Publish pushes an event to all connected clients. Events are JSON encoded.
+func (s *Streamer) Publish(event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("unable to encode stream event %v: %v", event, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	s.lastID++
+	e := streamEvent{s.lastID, data}
+	if s.maxHist > 0 {
+		s.history = append(s.history, e)
+		if len(s.history) > s.maxHist {
+			s.history = s.history[len(s.history)-s.maxHist:]
+		}
+	}
+	for c := range s.clients {
+		select {
+		case c.events <- e:
+		default:
+			log.Warnf("stream client too slow, dropping it at event %d", e.id)
+			s.drop(c)
+		}
+	}
+}
+
+// Close disconnects all clients and stops listening to the source
+func (s *Streamer) Close() {
+	s.stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	close(s.closed)
+	for c := range s.clients {
+		s.drop(c)
+	}
+}
+
+// ServeSSE streams events to the client as "text/event-stream"
+func (s *Streamer) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	log := apid.LogWithContext(r.Context(), log)
+
+	c, backlog := s.subscribe(lastEventID(r, r.Header.Get(lastEventIDHeader)))
+	defer s.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	setWriteDeadline(w, r, s.writeWait)
+	fmt.Fprintf(w, "retry: %d\n\n", s.heartbeat/time.Millisecond)
+	flusher.Flush()
+
+	// streams outlive api_write_timeout, each write gets its own deadline instead
+	write := func(e streamEvent) bool {
+		setWriteDeadline(w, r, s.writeWait)
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.id, e.data); err != nil {
+			log.Debugf("sse write failed: %v", err)
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	for _, e := range backlog {
+		if !write(e) {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-c.events:
+			if !write(e) {
+				return
+			}
+		case <-ticker.C:
+			setWriteDeadline(w, r, s.writeWait)
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-c.dropped:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ServeWebSocket upgrades the request to a WebSocket and streams events as text messages of the form:
+// {"id": <event id>, "data": <event>}
+func (s *Streamer) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	log := apid.LogWithContext(r.Context(), log)
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debugf("websocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	c, backlog := s.subscribe(lastEventID(r, r.URL.Query().Get(lastEventIDParam)))
+	defer s.unsubscribe(c)
+
+	// reader: handles pong and close frames, detects disconnect
+	gone := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(2 * s.heartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * s.heartbeat))
+	})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(e streamEvent) bool {
+		conn.SetWriteDeadline(time.Now().Add(s.writeWait))
+		msg := fmt.Sprintf(`{"id":%d,"data":%s}`, e.id, e.data)
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			log.Debugf("websocket write failed: %v", err)
+			return false
+		}
+		return true
+	}
+
+	for _, e := range backlog {
+		if !write(e) {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-c.events:
+			if !write(e) {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.writeWait)); err != nil {
+				return
+			}
+		case <-c.dropped:
+			msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "client too slow")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(s.writeWait))
+			return
+		case <-gone:
+			return
+		}
+	}
+}
+
+// registers a client, returns retained events after lastID to replay
+func (s *Streamer) subscribe(lastID int64) (*streamClient, []streamEvent) {
+	c := &streamClient{
+		events:  make(chan streamEvent, s.queueSize),
+		dropped: make(chan struct{}),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var backlog []streamEvent
+	if lastID >= 0 {
+		for _, e := range s.history {
+			if e.id > lastID {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	select {
+	case <-s.closed:
+		close(c.dropped)
+	default:
+		s.clients[c] = true
+	}
+	return c, backlog
+}
+
+func (s *Streamer) unsubscribe(c *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+}
+
+// must hold lock
+func (s *Streamer) drop(c *streamClient) {
+	if s.clients[c] {
+		delete(s.clients, c)
+		close(c.dropped)
+	}
+}
+
+// -1 if none or invalid, meaning no resume
+func lastEventID(r *http.Request, value string) int64 {
+	if value == "" {
+		return -1
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		apid.LogWithContext(r.Context(), log).Debugf("ignoring invalid last event id: %s", value)
+		return -1
+	}
+	return id
+}
+
+type streamHandler struct {
+	s *Streamer
+}
+
+func (h *streamHandler) Handle(event apid.Event) {
+	h.s.Publish(event)
+}
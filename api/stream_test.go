@@ -0,0 +1,165 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/api"
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Streaming", func() {
+	const selector apid.EventSelector = "stream test"
+
+	var streamer *api.Streamer
+
+	AfterEach(func() {
+		if streamer != nil {
+			streamer.Close()
+			streamer = nil
+		}
+	})
+
+	// reads SSE events from the stream, skipping comments and retry lines
+	readSSE := func(r *bufio.Reader, n int) (ids, data []string) {
+		for len(data) < n {
+			line, err := r.ReadString('\n')
+			Expect(err).NotTo(HaveOccurred())
+			line = strings.TrimSuffix(line, "\n")
+			if strings.HasPrefix(line, "id: ") {
+				ids = append(ids, strings.TrimPrefix(line, "id: "))
+			} else if strings.HasPrefix(line, "data: ") {
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+		return
+	}
+
+	parseIDs := func(ids []string) []int64 {
+		parsed := make([]int64, len(ids))
+		for i, id := range ids {
+			n, err := strconv.ParseInt(id, 10, 64)
+			Expect(err).NotTo(HaveOccurred())
+			parsed[i] = n
+		}
+		return parsed
+	}
+
+	It("should push events over SSE as they arrive", func() {
+		streamer = api.NewEventsStreamer(apid.Events(), selector)
+		server := httptest.NewServer(http.HandlerFunc(streamer.ServeSSE))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+		r := bufio.NewReader(resp.Body)
+
+		<-apid.Events().Emit(selector, "one")
+		<-apid.Events().Emit(selector, "two")
+		ids, data := readSSE(r, 2)
+		Expect(parseIDs(ids)[1]).To(Equal(parseIDs(ids)[0] + 1))
+		Expect(data).To(Equal([]string{`"one"`, `"two"`}))
+	}, 3)
+
+	It("should resume from Last-Event-ID", func() {
+		streamer = api.NewEventsStreamer(apid.Events(), selector)
+		server := httptest.NewServer(http.HandlerFunc(streamer.ServeSSE))
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		Expect(err).NotTo(HaveOccurred())
+		for _, e := range []string{"one", "two", "three"} {
+			streamer.Publish(e)
+		}
+		seen, _ := readSSE(bufio.NewReader(resp.Body), 3)
+		resp.Body.Close()
+
+		req, err := http.NewRequest("GET", server.URL, nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Last-Event-ID", seen[0])
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		ids, data := readSSE(bufio.NewReader(resp.Body), 2)
+		Expect(ids).To(Equal(seen[1:]))
+		Expect(data).To(Equal([]string{`"two"`, `"three"`}))
+	}, 3)
+
+	It("should not reuse IDs of a previous Streamer", func() {
+		published := func(s *api.Streamer) int64 {
+			server := httptest.NewServer(http.HandlerFunc(s.ServeSSE))
+			defer server.Close()
+			resp, err := http.Get(server.URL)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			s.Publish("event")
+			ids, _ := readSSE(bufio.NewReader(resp.Body), 1)
+			return parseIDs(ids)[0]
+		}
+
+		streamer = api.NewEventsStreamer(apid.Events(), selector)
+		before := published(streamer)
+		streamer.Close()
+
+		// eg. after a restart
+		streamer = api.NewEventsStreamer(apid.Events(), selector)
+		Expect(published(streamer)).To(BeNumerically(">", before))
+	}, 3)
+
+	It("should push distributed events over a WebSocket", func() {
+		addSubscriber := make(chan chan interface{})
+		streamer = api.NewDistributeStreamer(addSubscriber)
+		server := httptest.NewServer(http.HandlerFunc(streamer.ServeWebSocket))
+		defer server.Close()
+
+		// resumes from before the first event, however late the client subscribes
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?last_event_id=0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		// delivers like util.DistributeEvents, to the subscription of each element
+		for _, e := range []string{"one", "two"} {
+			sub := <-addSubscriber
+			sub <- e
+			close(sub)
+		}
+
+		var ids []int64
+		for _, e := range []string{"one", "two"} {
+			var m struct {
+				ID   int64  `json:"id"`
+				Data string `json:"data"`
+			}
+			_, b, err := conn.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(b, &m)).To(Succeed())
+			Expect(m.Data).To(Equal(e))
+			ids = append(ids, m.ID)
+		}
+		Expect(ids[1]).To(Equal(ids[0] + 1))
+	}, 3)
+})
@@ -14,7 +14,10 @@
 
 package apid
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 type APIService interface {
 	Listen() error
@@ -22,12 +25,30 @@ type APIService interface {
 	HandleFunc(path string, handlerFunc http.HandlerFunc) Route
 	Vars(r *http.Request) map[string]string
 
+	// admin routes are served on the admin listener (api_admin_listen) if configured, otherwise on the
+	// api listener, and require the admin auth token (api_admin_auth_token) unless api_admin_insecure is set
+	HandleAdmin(path string, handler http.Handler) Route
+	HandleAdminFunc(path string, handlerFunc http.HandlerFunc) Route
+
+	// request ID of the request: taken from the X-Request-ID header or generated
+	RequestID(r *http.Request) string
+	// logger tagged with the request ID (and principal, if set)
+	RequestLog(r *http.Request) LogService
+	// authenticated principal of the request, or "" if none
+	Principal(r *http.Request) string
+	// returns a copy of the request carrying the authenticated principal (eg. for auth middleware)
+	WithPrincipal(r *http.Request, principal string) *http.Request
+
 	// for testing
 	Router() Router
 }
 
 type Route interface {
 	Methods(methods ...string) Route
+	// overrides the api_write_timeout for this route (eg. long polling), 0 for no timeout
+	WriteTimeout(timeout time.Duration) Route
+	// overrides the api_max_body_size for this route, 0 for no limit
+	MaxBodySize(bytes int64) Route
 }
 
 // for testing
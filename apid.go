@@ -18,6 +18,7 @@ import (
 	"errors"
 	"github.com/apid/apid-core/util"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -30,6 +31,7 @@ const (
 	configfwdProxyUser                  = "configfwdproxy_user"
 	configfwdProxyPasswd                = "configfwdproxy_passwd"
 	configfwdProxyPort                  = "configfwdproxy_port"
+	configStrict                        = "apid_config_strict"
 )
 
 var (
@@ -49,10 +51,30 @@ type Services interface {
 	Log() LogService
 }
 
+var configKeys = []ConfigKey{
+	{
+		Key:         configStrict,
+		Type:        ConfigTypeBool,
+		Default:     true,
+		Description: "fail on unknown keys in the config file, only log a warning if false",
+	},
+	{Key: configfwdProxyURL, Type: ConfigTypeString, Description: "forward proxy host"},
+	{
+		Key:         configfwdProxyProt,
+		Type:        ConfigTypeString,
+		Default:     "https",
+		Description: "forward proxy protocol",
+		Enum:        []string{"http", "https"},
+	},
+	{Key: configfwdProxyUser, Type: ConfigTypeString, Description: "forward proxy user"},
+	{Key: configfwdProxyPasswd, Type: ConfigTypeString, Description: "forward proxy password", Secret: true},
+	{Key: configfwdProxyPort, Type: ConfigTypeInt, Description: "forward proxy port", Min: 1, Max: 65535},
+	{Key: util.ConfigfwdProxyPortURL, Description: "forward proxy URL, set from the configfwdproxy_* keys", Secret: true},
+}
+
 func setFwdProxyConfig(config ConfigService) {
 	var pURL string
 
-	config.SetDefault(configfwdProxyProt, "https")
 	fwdPrxy := config.GetString(configfwdProxyURL)
 	fwdprxyProt := config.GetString(configfwdProxyProt)
 	fwdPrxyUser := config.GetString(configfwdProxyUser)
@@ -70,8 +92,9 @@ type PluginInitFunc func(Services) (PluginData, error)
 
 // passed Services can be a factory - makes copies and maintains returned references
 // eg. apid.Initialize(factory.DefaultServicesFactory())
+// returns a *ConfigError listing the invalid config values, the services are available anyway.
 
-func Initialize(s Services) {
+func Initialize(s Services) error {
 	ss := &servicesSet{}
 	services = ss
 	// order is important
@@ -83,12 +106,19 @@ func Initialize(s Services) {
 	if err := os.MkdirAll(lsp, 0700); err != nil {
 		ss.log.Panicf("can't create local storage path %s: %v", lsp, err)
 	}
+	ss.config.Register(configKeys...)
 	setFwdProxyConfig(ss.config)
 	ss.events = s.Events()
 	ss.api = s.API()
 	ss.data = s.Data()
 
+	// plugins may register more keys, unknown keys are checked once they're initialized
+	if err := validateConfig(false); err != nil {
+		return err
+	}
+
 	ss.events.Emit(SystemEventsSelector, APIDInitializedEvent)
+	return nil
 }
 
 func RegisterPlugin(plugin PluginInitFunc, pluginData PluginData) {
@@ -96,7 +126,8 @@ func RegisterPlugin(plugin PluginInitFunc, pluginData PluginData) {
 	PluginVersionTracker = append(PluginVersionTracker, pluginData)
 }
 
-func InitializePlugins(versionNumber string) {
+// returns a *ConfigError listing the invalid config values and the unknown config keys, see apid_config_strict
+func InitializePlugins(versionNumber string) error {
 	log := Log()
 	log.Debugf("Initializing %d plugins...", len(pluginInitFuncs))
 	pie := PluginsInitializedEvent{
@@ -111,8 +142,12 @@ func InitializePlugins(versionNumber string) {
 		pie.Plugins = append(pie.Plugins, pluginData)
 	}
 	pluginInitFuncs = nil
+	if err := validateConfig(true); err != nil {
+		return err
+	}
 	Events().Emit(SystemEventsSelector, pie)
 	log.Debugf("done initializing plugins")
+	return nil
 }
 
 // Shutdown all the plugins that have registered for ShutdownEventSelector.
@@ -133,6 +168,26 @@ func ShutdownPluginsAndWait() error {
 	}
 }
 
+// the invalid config values and, if checkUnknown, the unknown config keys unless apid_config_strict is false
+// (warns then)
+func validateConfig(checkUnknown bool) error {
+	err := Config().Validate()
+	e, ok := err.(*ConfigError)
+	if !ok {
+		return err
+	}
+	if !checkUnknown {
+		e.Unknown = nil
+	} else if len(e.Unknown) > 0 && !Config().GetBool(configStrict) {
+		Log().Warnf("unknown config keys: %s", strings.Join(e.Unknown, ", "))
+		e.Unknown = nil
+	}
+	if len(e.Invalid) > 0 || len(e.Unknown) > 0 {
+		return e
+	}
+	return nil
+}
+
 func AllServices() Services {
 	return services
 }
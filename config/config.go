@@ -16,11 +16,15 @@ package config
 
 import (
 	"github.com/apid/apid-core"
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,81 +45,114 @@ const (
 var configlock sync.Mutex
 
 type ConfigMgr struct {
+	// serializes changes, reads use the published snapshot
 	sync.Mutex
-	vcfg *viper.Viper
+	current atomic.Value
+	// main config file
+	file string
+	// registered keys
+	keys map[string]apid.ConfigKey
+	// registered keys and keys given a default
+	known map[string]bool
+	// sources of the settings, see snapshot.go
+	defaults  map[string]interface{}
+	files     map[string]interface{}
+	env       map[string]string
+	flags     map[string]*pflag.Flag
+	overrides map[string]interface{}
+	// keys in the config files, and the file providing their value
+	fileKeys map[string]string
+	// resolved secret references
+	secrets map[string]resolvedSecret
+	// notified on reload
+	listeners []changeListener
 }
 
-// Wrapper function to make the viper calls thread safe
 var cfg *ConfigMgr
 
 func (c *ConfigMgr) SetDefault(key string, value interface{}) {
 	c.Lock()
-	c.vcfg.SetDefault(key, value)
-	c.Unlock()
+	defer c.Unlock()
+	key = strings.ToLower(key)
+	c.defaults[key] = value
+	c.known[key] = true
+	c.publish()
 }
 
 func (c *ConfigMgr) Set(key string, value interface{}) {
 	c.Lock()
-	c.vcfg.Set(key, value)
-	c.Unlock()
+	defer c.Unlock()
+	c.overrides[strings.ToLower(key)] = value
+	c.publish()
 }
 
 func (c *ConfigMgr) Get(key string) interface{} {
-	c.Lock()
-	defer c.Unlock()
-	allowLowercaseEnv(key)
-	return c.vcfg.Get(key)
+	return c.get(key)
 }
 
 func (c *ConfigMgr) GetBool(key string) bool {
-	c.Lock()
-	defer c.Unlock()
-	allowLowercaseEnv(key)
-	return c.vcfg.GetBool(key)
+	return cast.ToBool(c.get(key))
 }
 
 func (c *ConfigMgr) GetFloat64(key string) float64 {
-	c.Lock()
-	defer c.Unlock()
-	allowLowercaseEnv(key)
-	return c.vcfg.GetFloat64(key)
+	return cast.ToFloat64(c.get(key))
 }
 
 func (c *ConfigMgr) GetInt(key string) int {
-	c.Lock()
-	defer c.Unlock()
-	allowLowercaseEnv(key)
-	return c.vcfg.GetInt(key)
+	return cast.ToInt(c.get(key))
 }
 
 func (c *ConfigMgr) GetString(key string) string {
-	cfg.Lock()
-	defer cfg.Unlock()
-	allowLowercaseEnv(key)
-	return c.vcfg.GetString(key)
+	return cast.ToString(c.get(key))
 }
 
 func (c *ConfigMgr) GetDuration(key string) time.Duration {
-	cfg.Lock()
-	defer cfg.Unlock()
-	allowLowercaseEnv(key)
-	return c.vcfg.GetDuration(key)
+	return cast.ToDuration(c.get(key))
 }
 
-func (c *ConfigMgr) IsSet(key string) bool {
-	c.Lock()
-	defer c.Unlock()
-	allowLowercaseEnv(key)
-	return c.vcfg.IsSet(key)
+func (c *ConfigMgr) GetInt64(key string) int64 {
+	return cast.ToInt64(c.get(key))
+}
+
+func (c *ConfigMgr) GetStringSlice(key string) []string {
+	return toStringSlice(c.get(key))
+}
+
+func (c *ConfigMgr) GetStringMap(key string) map[string]interface{} {
+	m, err := toStringMapE(c.get(key))
+	if err != nil {
+		log.Printf("Invalid map in config key '%s': %s", key, err)
+	}
+	return m
 }
 
-// hack to allow lowercase env vars to be read by Viper AutomaticEnv()
-func allowLowercaseEnv(key string) {
-	envKey := "apid_" + key
-	if os.Getenv(envKey) != "" {
-		kUpper := "APID_" + strings.ToUpper(key)
-		os.Setenv(kUpper, os.Getenv(envKey))
+func (c *ConfigMgr) GetStringMapString(key string) map[string]string {
+	return cast.ToStringMapString(c.GetStringMap(key))
+}
+
+// an invalid size is logged, and the registered default returned if any
+func (c *ConfigMgr) GetSizeInBytes(key string) uint {
+	n, err := toSizeE(c.get(key))
+	if err == nil {
+		return uint(n)
 	}
+	c.Lock()
+	def := c.keys[strings.ToLower(key)].Default
+	c.Unlock()
+	if n, derr := toSizeE(def); def != nil && derr == nil {
+		log.Printf("Invalid %s, using default %v: %v", key, def, err)
+		return uint(n)
+	}
+	log.Printf("Invalid %s: %v", key, err)
+	return 0
+}
+
+func (c *ConfigMgr) GetTime(key string) time.Time {
+	return cast.ToTime(c.get(key))
+}
+
+func (c *ConfigMgr) IsSet(key string) bool {
+	return c.get(key) != nil
 }
 
 func GetConfig() apid.ConfigService {
@@ -125,7 +162,7 @@ func GetConfig() apid.ConfigService {
 
 		vcfg := viper.New()
 
-		// for config file search path
+		// the merged config files, see layers.go
 		vcfg.SetConfigType(configFileType)
 
 		vcfg.SetDefault(configPathKey, defaultConfigPath)
@@ -134,8 +171,12 @@ func GetConfig() apid.ConfigService {
 
 		vcfg.SetDefault(configFileNameKey, defaultConfigFilename)
 		configFileName := vcfg.GetString(configFileNameKey)
-		configFileName = strings.TrimSuffix(configFileName, ".yaml")
-		vcfg.SetConfigName(configFileName)
+		if _, err := os.Stat(filepath.Join(configFilePath, configFileName)); err == nil {
+			vcfg.SetConfigFile(filepath.Join(configFilePath, configFileName))
+		} else {
+			// search for the name with any supported extension
+			vcfg.SetConfigName(strings.TrimSuffix(configFileName, filepath.Ext(configFileName)))
+		}
 
 		// for user-specified absolute config file
 		configFile, ok := os.LookupEnv(configFileEnvVar)
@@ -143,17 +184,45 @@ func GetConfig() apid.ConfigService {
 			vcfg.SetConfigFile(configFile)
 		}
 
-		vcfg.SetDefault(localStoragePathKey, localStoragePathDefault)
-
+		// locates the main config file, other errors are reported when loading the layers
 		err := vcfg.ReadInConfig()
-		if err != nil {
+		if _, notFound := err.(viper.ConfigFileNotFoundError); notFound {
 			log.Printf("Error in config file '%s': %s", configFileNameKey, err)
 		}
 
-		vcfg.SetEnvPrefix("apid") // eg. env var "APID_SOMETHING" will bind to config var "something"
-		vcfg.AutomaticEnv()
+		cfg = &ConfigMgr{
+			file:      vcfg.ConfigFileUsed(),
+			keys:      make(map[string]apid.ConfigKey),
+			known:     make(map[string]bool),
+			defaults:  make(map[string]interface{}),
+			files:     make(map[string]interface{}),
+			env:       environ(),
+			flags:     make(map[string]*pflag.Flag),
+			overrides: make(map[string]interface{}),
+			fileKeys:  make(map[string]string),
+			secrets:   make(map[string]resolvedSecret),
+		}
+		cfg.Register(configKeys...)
+
+		cfg.Lock()
+		// the main file may list more config files
+		if cfg.file != "" {
+			if main, errs := readLayers([]string{cfg.file}, cfg.configType()); len(errs) == 0 {
+				cfg.apply(main)
+			}
+		}
+		// layers that can't be read are skipped
+		_, layers, errs := cfg.readLayers()
+		for _, err := range errs {
+			log.Printf("Error in %s", err)
+		}
+		cfg.apply(layers)
+		cfg.Unlock()
 
-		cfg = &ConfigMgr{vcfg: vcfg}
+		// reload on file change or SIGHUP
+		if cfg.GetBool(configWatchKey) {
+			cfg.watch()
+		}
 	}
 	return cfg
 }
@@ -0,0 +1,69 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apid/apid-core/config"
+)
+
+// go test -run NONE -bench . ./config/
+
+func benchConfig(b *testing.B) {
+	os.Setenv("apid_bench_env", "from env")
+	c := config.GetConfig()
+	c.SetDefault("bench_default", "default")
+	c.SetDefault("bench_duration", time.Second)
+	c.(*config.ConfigMgr).Reload()
+	b.ReportAllocs()
+	b.ResetTimer()
+}
+
+func BenchmarkGetString(b *testing.B) {
+	benchConfig(b)
+	c := config.GetConfig()
+	for i := 0; i < b.N; i++ {
+		c.GetString("bench_default")
+	}
+}
+
+func BenchmarkGetStringEnv(b *testing.B) {
+	benchConfig(b)
+	c := config.GetConfig()
+	for i := 0; i < b.N; i++ {
+		c.GetString("bench_env")
+	}
+}
+
+func BenchmarkGetDuration(b *testing.B) {
+	benchConfig(b)
+	c := config.GetConfig()
+	for i := 0; i < b.N; i++ {
+		c.GetDuration("bench_duration")
+	}
+}
+
+func BenchmarkGetStringParallel(b *testing.B) {
+	benchConfig(b)
+	c := config.GetConfig()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.GetString("bench_default")
+		}
+	})
+}
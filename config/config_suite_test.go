@@ -19,15 +19,52 @@ import (
 	. "github.com/onsi/gomega"
 
 	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/config"
 	"github.com/apid/apid-core/factory"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
+var tmpDir, configFile string
+
 var _ = BeforeSuite(func() {
+	var err error
+	tmpDir, err = ioutil.TempDir("", "config_test")
+	Expect(err).NotTo(HaveOccurred())
+	configFile = filepath.Join(tmpDir, "apid_config.yaml")
+	Expect(ioutil.WriteFile(configFile, []byte("reload_test: one\n"), 0600)).To(Succeed())
+	os.Setenv("APID_CONFIG_FILE", configFile)
+
 	apid.Initialize(factory.DefaultServicesFactory())
 	apid.Config().SetDefault("test", "test")
 })
 
+// env vars are read when the config is loaded
+func setEnv(name, value string) {
+	os.Setenv(name, value)
+	Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+}
+
+func unsetEnv(name string) {
+	os.Unsetenv(name)
+	Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+}
+
+type changeHandler chan apid.ConfigChangedEvent
+
+func (h changeHandler) Handle(e apid.Event) {
+	select {
+	case h <- e.(apid.ConfigChangedEvent):
+	default:
+	}
+}
+
+var _ = AfterSuite(func() {
+	os.RemoveAll(tmpDir)
+})
+
 func TestEvents(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Config Suite")
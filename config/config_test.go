@@ -15,10 +15,17 @@
 package config_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"flag"
 	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/cipher"
+	"github.com/apid/apid-core/config"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -31,38 +38,584 @@ var _ = Describe("Config Service", func() {
 		})
 
 		It("as interface", func() {
-			os.Setenv("apid_test", "TEST")
+			setEnv("apid_test", "TEST")
 			Expect(apid.Config().Get("test")).To(Equal("TEST"))
 		})
 
 		It("as bool", func() {
-			os.Setenv("apid_test", "true")
+			setEnv("apid_test", "true")
 			Expect(apid.Config().GetBool("test")).To(BeTrue())
 		})
 
 		It("as float", func() {
-			os.Setenv("apid_test", "64.1")
+			setEnv("apid_test", "64.1")
 			Expect(apid.Config().GetFloat64("test")).To(Equal(64.1))
 		})
 
 		It("as int", func() {
-			os.Setenv("apid_test", "64")
+			setEnv("apid_test", "64")
 			Expect(apid.Config().GetInt("test")).To(Equal(64))
 		})
 
 		It("as string", func() {
-			os.Setenv("apid_test", "TEST")
+			setEnv("apid_test", "TEST")
 			Expect(apid.Config().GetString("test")).To(Equal("TEST"))
 		})
 
 		It("as duration", func() {
-			os.Setenv("apid_test", "300ms")
+			setEnv("apid_test", "300ms")
 			Expect(apid.Config().GetDuration("test")).To(Equal(300 * time.Millisecond))
 		})
 
 		It("as IsSet", func() {
-			os.Setenv("apid_test", "300ms")
+			setEnv("apid_test", "300ms")
 			Expect(apid.Config().IsSet("test")).To(BeTrue())
 		})
+
+		It("as int64", func() {
+			setEnv("apid_test", "8589934592")
+			Expect(apid.Config().GetInt64("test")).To(Equal(int64(8589934592)))
+		})
+
+		It("as string slice", func() {
+			setEnv("apid_test", "a.com, b.com")
+			Expect(apid.Config().GetStringSlice("test")).To(Equal([]string{"a.com", "b.com"}))
+			setEnv("apid_test", "[a.com, b.com]")
+			Expect(apid.Config().GetStringSlice("test")).To(Equal([]string{"a.com", "b.com"}))
+		})
+
+		It("as string map", func() {
+			setEnv("apid_test", "x-a=1, x-b=2")
+			Expect(apid.Config().GetStringMapString("test")).To(Equal(map[string]string{"x-a": "1", "x-b": "2"}))
+			setEnv("apid_test", `{"x-a": 1, "x-b": 2}`)
+			Expect(apid.Config().GetStringMap("test")).To(Equal(map[string]interface{}{"x-a": 1, "x-b": 2}))
+		})
+
+		It("as size", func() {
+			setEnv("apid_test", "10MB")
+			Expect(apid.Config().GetSizeInBytes("test")).To(Equal(uint(10 << 20)))
+			setEnv("apid_test", "9000000000gb")
+			Expect(apid.Config().GetSizeInBytes("test")).To(BeZero())
+			setEnv("apid_test", "10 MiB")
+			Expect(apid.Config().GetSizeInBytes("test")).To(BeZero())
+		})
+
+		It("as size, the registered default if invalid", func() {
+			apid.Config().Register(apid.ConfigKey{Key: "size_fallback", Type: apid.ConfigTypeString, Default: "1kb"})
+			setEnv("apid_size_fallback", "10 MiB")
+			defer unsetEnv("apid_size_fallback")
+			Expect(apid.Config().GetSizeInBytes("size_fallback")).To(Equal(uint(1024)))
+		})
+
+		It("as time", func() {
+			setEnv("apid_test", "2017-06-01T10:00:00Z")
+			Expect(apid.Config().GetTime("test")).To(Equal(time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)))
+		})
+	})
+
+	Context("reload", func() {
+
+		var changes changeHandler
+
+		BeforeEach(func() {
+			changes = make(changeHandler, 10)
+			apid.Events().Listen(apid.ConfigChangedSelector, changes)
+		})
+
+		AfterEach(func() {
+			apid.Events().StopListening(apid.ConfigChangedSelector, changes)
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: one\n"), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+		})
+
+		It("applies changed values and emits changed keys", func() {
+			Expect(apid.Config().GetString("reload_test")).To(Equal("one"))
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: two\nreload_added: 1\n"), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+			Expect(apid.Config().GetString("reload_test")).To(Equal("two"))
+			Expect(apid.Config().GetInt("reload_added")).To(Equal(1))
+
+			// earlier reloads may still be delivered
+			Eventually(changes).Should(Receive(Equal(apid.ConfigChangedEvent{
+				Description: "config changed",
+				Keys:        []string{"reload_added", "reload_test"},
+			})))
+		})
+
+		It("keeps current config if the file is invalid", func() {
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: [two\n"), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).NotTo(Succeed())
+			Expect(apid.Config().GetString("reload_test")).To(Equal("one"))
+		})
+
+		It("reloads when the file changes", func() {
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: three\n"), 0600)).To(Succeed())
+			Eventually(func() string {
+				return apid.Config().GetString("reload_test")
+			}).Should(Equal("three"))
+		})
+	})
+
+	Context("schema", func() {
+
+		AfterEach(func() {
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: one\n"), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+		})
+
+		It("sets defaults and describes registered keys", func() {
+			apid.Config().Register(apid.ConfigKey{
+				Key:         "schema_default",
+				Type:        apid.ConfigTypeDuration,
+				Default:     time.Second,
+				Description: "a duration",
+				Min:         time.Millisecond,
+			})
+			Expect(apid.Config().GetDuration("schema_default")).To(Equal(time.Second))
+
+			var buf bytes.Buffer
+			apid.Config().Usage(&buf)
+			Expect(buf.String()).To(ContainSubstring("schema_default (duration, env APID_SCHEMA_DEFAULT, flag --schema_default)"))
+			Expect(buf.String()).To(ContainSubstring("a duration"))
+			Expect(buf.String()).To(ContainSubstring("default: 1s, min: 1ms"))
+		})
+
+		It("lists every invalid and unknown key", func() {
+			apid.Config().Register(
+				apid.ConfigKey{Key: "schema_int", Type: apid.ConfigTypeInt},
+				apid.ConfigKey{Key: "schema_range", Type: apid.ConfigTypeInt, Min: 1, Max: 10},
+				apid.ConfigKey{Key: "schema_enum", Enum: []string{"a", "b"}},
+				apid.ConfigKey{Key: "schema_required", Required: true},
+				apid.ConfigKey{Key: "reload_test"},
+			)
+			Expect(ioutil.WriteFile(configFile, []byte(
+				"reload_test: one\nschema_int: abc\nschema_range: 11\nschema_enum: c\nschema_typo: 1\n"),
+				0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+
+			err := apid.Config().Validate()
+			Expect(err).To(HaveOccurred())
+			e := err.(*apid.ConfigError)
+			Expect(e.Invalid).To(Equal([]string{
+				"schema_enum: value 'c' is not one of: a, b",
+				"schema_int: invalid int value 'abc'",
+				"schema_range: value '11' is greater than 10",
+				"schema_required: required",
+			}))
+			Expect(e.Unknown).To(Equal([]string{"schema_typo"}))
+		})
+
+		It("validates sizes", func() {
+			apid.Config().Register(apid.ConfigKey{Key: "schema_size", Type: apid.ConfigTypeSize, Max: "1MB"})
+			defer apid.Config().Set("schema_size", "1kb")
+
+			apid.Config().Set("schema_size", "2MB")
+			err := apid.Config().Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*apid.ConfigError).Invalid).To(ContainElement("schema_size: value '2MB' is greater than 1MB"))
+
+			apid.Config().Set("schema_size", "lots")
+			err = apid.Config().Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*apid.ConfigError).Invalid).To(ContainElement("schema_size: invalid size value 'lots'"))
+		})
+
+		It("validates env values", func() {
+			apid.Config().Register(apid.ConfigKey{Key: "schema_env", Type: apid.ConfigTypeBool})
+			setEnv("apid_schema_env", "maybe")
+			defer unsetEnv("apid_schema_env")
+			err := apid.Config().Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*apid.ConfigError).Invalid).To(ContainElement("schema_env: invalid bool value 'maybe'"))
+		})
+
+		It("fails plugin initialization on unknown keys unless apid_config_strict is false", func() {
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: one\nschema_plugin_typo: 1\n"),
+				0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+			noop := func(apid.Services) (apid.PluginData, error) {
+				return apid.PluginData{Name: "noop"}, nil
+			}
+
+			apid.RegisterPlugin(noop, apid.PluginData{Name: "noop"})
+			err := apid.InitializePlugins("test")
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*apid.ConfigError).Unknown).To(ContainElement("schema_plugin_typo"))
+
+			apid.Config().Set("apid_config_strict", false)
+			defer apid.Config().Set("apid_config_strict", true)
+			apid.RegisterPlugin(noop, apid.PluginData{Name: "noop"})
+			if err := apid.InitializePlugins("test"); err != nil {
+				Expect(err.(*apid.ConfigError).Unknown).To(BeEmpty())
+			}
+		})
+	})
+
+	Context("introspection", func() {
+
+		It("lists keys with their sources", func() {
+			apid.Config().SetDefault("source_default", "a")
+			apid.Config().Set("source_set", "b")
+			setEnv("APID_SOURCE_ENV", "c")
+			defer unsetEnv("APID_SOURCE_ENV")
+			apid.Config().Register(apid.ConfigKey{Key: "source_env"})
+
+			keys := apid.Config().AllKeys()
+			Expect(keys).To(ContainElement("source_default"))
+			Expect(keys).To(ContainElement("source_set"))
+			Expect(keys).To(ContainElement("source_env"))
+			Expect(keys).To(ContainElement("reload_test"))
+			Expect(keys).NotTo(ContainElement("source_none"))
+
+			settings := apid.Config().AllSettings()
+			Expect(settings["source_env"]).To(Equal("c"))
+			Expect(settings["reload_test"]).To(Equal("one"))
+
+			Expect(apid.Config().Source("source_default")).To(Equal(apid.ConfigSourceDefault))
+			Expect(apid.Config().Source("source_set")).To(Equal(apid.ConfigSourceSet))
+			Expect(apid.Config().Source("source_env")).To(Equal(apid.ConfigSourceEnv))
+			Expect(apid.Config().Source("reload_test")).To(Equal(apid.ConfigSourceFile))
+			Expect(apid.Config().Source("source_none")).To(Equal(apid.ConfigSourceNone))
+		})
+
+		It("identifies secrets", func() {
+			apid.Config().Register(apid.ConfigKey{Key: "secret_registered", Secret: true})
+			Expect(apid.Config().IsSecret("secret_registered")).To(BeTrue())
+			Expect(apid.Config().IsSecret("configfwdproxy_passwd")).To(BeTrue())
+			Expect(apid.Config().IsSecret("api_tls_key")).To(BeTrue())
+			Expect(apid.Config().IsSecret("my_auth_token")).To(BeTrue())
+			Expect(apid.Config().IsSecret("api_tls_cert")).To(BeFalse())
+			Expect(apid.Config().IsSecret("log_level")).To(BeFalse())
+		})
+	})
+
+	Context("secret references", func() {
+
+		AfterEach(func() {
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: one\n"), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+		})
+
+		It("resolves files and re-resolves them on reload", func() {
+			apid.Config().Register(apid.ConfigKey{Key: "secret_ref", Secret: true})
+			secretFile := filepath.Join(tmpDir, "secret")
+			Expect(ioutil.WriteFile(secretFile, []byte("s3cret\n"), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: one\nsecret_ref: file://"+secretFile+"\n"),
+				0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+
+			Expect(apid.Config().GetString("secret_ref")).To(Equal("s3cret"))
+			Expect(apid.Config().AllSettings()["secret_ref"]).To(Equal("s3cret"))
+			Expect(apid.Config().IsSecret("secret_ref")).To(BeTrue())
+
+			Expect(ioutil.WriteFile(secretFile, []byte("rotated"), 0600)).To(Succeed())
+			Expect(apid.Config().GetString("secret_ref")).To(Equal("s3cret"))
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+			Expect(apid.Config().GetString("secret_ref")).To(Equal("rotated"))
+		})
+
+		It("decrypts enc: values", func() {
+			key := []byte("0123456789abcdef")
+			keyFile := filepath.Join(tmpDir, "key")
+			Expect(ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600)).To(Succeed())
+			aes, err := cipher.CreateAesCipher(key)
+			Expect(err).NotTo(HaveOccurred())
+			ciphertext, err := aes.Encrypt([]byte("hunter2"), cipher.ModeEcb, cipher.PaddingPKCS7)
+			Expect(err).NotTo(HaveOccurred())
+
+			apid.Config().Register(apid.ConfigKey{Key: "secret_enc", Secret: true})
+			apid.Config().Set("apid_secrets_key_file", keyFile)
+			defer apid.Config().Set("apid_secrets_key_file", "")
+			setEnv("APID_SECRET_ENC", "enc:"+base64.StdEncoding.EncodeToString(ciphertext))
+			defer unsetEnv("APID_SECRET_ENC")
+			Expect(apid.Config().GetString("secret_enc")).To(Equal("hunter2"))
+		})
+
+		It("reports unresolvable references", func() {
+			setEnv("APID_SECRET_MISSING", "file://"+filepath.Join(tmpDir, "missing"))
+			defer unsetEnv("APID_SECRET_MISSING")
+			apid.Config().Register(apid.ConfigKey{Key: "secret_missing", Secret: true})
+			Expect(apid.Config().GetString("secret_missing")).To(BeEmpty())
+
+			err := apid.Config().Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("secret_missing: unable to resolve secret"))
+		})
+
+		It("returns references of keys not registered as secret as is", func() {
+			url := "file://" + filepath.Join(tmpDir, "missing")
+			setEnv("APID_PLAIN_URL", url)
+			defer unsetEnv("APID_PLAIN_URL")
+			apid.Config().Register(apid.ConfigKey{Key: "plain_url"})
+			Expect(apid.Config().GetString("plain_url")).To(Equal(url))
+			Expect(apid.Config().IsSecret("plain_url")).To(BeFalse())
+			if err := apid.Config().Validate(); err != nil {
+				Expect(err.Error()).NotTo(ContainSubstring("plain_url"))
+			}
+		})
+	})
+
+	Context("layers", func() {
+
+		AfterEach(func() {
+			apid.Config().Set("apid_config_files", "")
+			apid.Config().Set("apid_config_dir", "")
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: one\n"), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+		})
+
+		It("deep merges files and the config dir in order", func() {
+			write := func(file, content string) string {
+				Expect(os.MkdirAll(filepath.Dir(file), 0700)).To(Succeed())
+				Expect(ioutil.WriteFile(file, []byte(content), 0600)).To(Succeed())
+				return file
+			}
+			write(configFile, "reload_test: one\nnested:\n  a: 1\n  b: 2\n")
+			extra := write(filepath.Join(tmpDir, "extra.yaml"), "nested:\n  b: 3\nlayered: extra\n")
+			confDir := filepath.Join(tmpDir, "conf.d")
+			first := write(filepath.Join(confDir, "10-first.yaml"), "layered: first\nnested:\n  b: dir\n")
+			write(filepath.Join(confDir, "20-second.yml"), "nested:\n  c: 4\n")
+			write(filepath.Join(confDir, "30-ignored.txt"), "layered: ignored\n")
+
+			apid.Config().Set("apid_config_files", extra)
+			apid.Config().Set("apid_config_dir", confDir)
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+
+			Expect(apid.Config().GetInt("nested.a")).To(Equal(1))
+			Expect(apid.Config().GetString("nested.b")).To(Equal("dir"))
+			Expect(apid.Config().GetInt("nested.c")).To(Equal(4))
+			Expect(apid.Config().GetString("layered")).To(Equal("first"))
+			Expect(apid.Config().GetString("reload_test")).To(Equal("one"))
+
+			Expect(apid.Config().Source("layered")).To(Equal(apid.ConfigSourceFile))
+			Expect(apid.Config().SourceFile("layered")).To(Equal(first))
+			Expect(apid.Config().SourceFile("nested.a")).To(Equal(configFile))
+			Expect(apid.Config().SourceFile("nested.c")).To(Equal(filepath.Join(confDir, "20-second.yml")))
+		})
+
+		It("reads JSON, TOML and HCL layers by extension", func() {
+			confDir := filepath.Join(tmpDir, "formats.d")
+			Expect(os.MkdirAll(confDir, 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(confDir, "1.json"),
+				[]byte(`{"format_json": "json", "format_nested": {"a": 1, "b": 1}}`), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(confDir, "2.toml"),
+				[]byte("format_toml = \"toml\"\n[format_nested]\nb = 2\n"), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(confDir, "3.hcl"),
+				[]byte("format_hcl = \"hcl\"\n"), 0600)).To(Succeed())
+
+			apid.Config().Set("apid_config_dir", confDir)
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+
+			Expect(apid.Config().GetString("format_json")).To(Equal("json"))
+			Expect(apid.Config().GetString("format_toml")).To(Equal("toml"))
+			Expect(apid.Config().GetString("format_hcl")).To(Equal("hcl"))
+			Expect(apid.Config().GetInt("format_nested.a")).To(Equal(1))
+			Expect(apid.Config().GetInt("format_nested.b")).To(Equal(2))
+		})
+
+		It("reads files without a known extension as apid_config_type", func() {
+			extra := filepath.Join(tmpDir, "extra.conf")
+			Expect(ioutil.WriteFile(extra, []byte("format_typed = \"toml\"\n"), 0600)).To(Succeed())
+			apid.Config().Set("apid_config_type", "toml")
+			defer apid.Config().Set("apid_config_type", "yaml")
+			apid.Config().Set("apid_config_files", extra)
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+			Expect(apid.Config().GetString("format_typed")).To(Equal("toml"))
+		})
+
+		It("keeps the current config if any layer is invalid", func() {
+			extra := filepath.Join(tmpDir, "invalid.yaml")
+			Expect(ioutil.WriteFile(extra, []byte("layered: [\n"), 0600)).To(Succeed())
+			apid.Config().Set("apid_config_files", extra)
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: two\n"), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).NotTo(Succeed())
+			Expect(apid.Config().GetString("reload_test")).To(Equal("one"))
+		})
+	})
+
+	Context("unmarshal", func() {
+
+		type dbConfig struct {
+			Path  string
+			Conns int `config:"max_conns" default:"4"`
+		}
+		type pluginConfig struct {
+			Listen       string        `config:"listen,required"`
+			PollInterval time.Duration `default:"1m"`
+			MaxBody      int64         `config:"max_body,size" default:"10MB"`
+			Origins      []string      `config:"allowed_origins"`
+			DB           dbConfig      `config:"db"`
+			Ignored      string        `config:"-"`
+		}
+
+		AfterEach(func() {
+			unsetEnv("APID_UNMARSHAL_ALLOWED_ORIGINS")
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: one\n"), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+		})
+
+		It("decodes prefixed keys with defaults", func() {
+			apid.Config().Set("unmarshal_listen", ":9000")
+			apid.Config().Set("unmarshal_max_body", "1kb")
+			apid.Config().Set("unmarshal_db_path", "/tmp/db")
+			apid.Config().Set("unmarshal_ignored", "x")
+			setEnv("APID_UNMARSHAL_ALLOWED_ORIGINS", "a.com, b.com")
+
+			var c pluginConfig
+			Expect(apid.Config().Unmarshal("unmarshal_", &c)).To(Succeed())
+			Expect(c.Listen).To(Equal(":9000"))
+			Expect(c.PollInterval).To(Equal(time.Minute))
+			Expect(c.MaxBody).To(Equal(int64(1024)))
+			Expect(c.Origins).To(Equal([]string{"a.com", "b.com"}))
+			Expect(c.DB.Path).To(Equal("/tmp/db"))
+			Expect(c.DB.Conns).To(Equal(4))
+			Expect(c.Ignored).To(BeEmpty())
+		})
+
+		It("decodes a sub-tree", func() {
+			Expect(ioutil.WriteFile(configFile, []byte(`reload_test: one
+subtree:
+  listen: ":9001"
+  poll_interval: 5s
+  allowed_origins: [c.com]
+  db:
+    max_conns: 8
+`), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+
+			var c pluginConfig
+			Expect(apid.Config().Unmarshal("subtree.", &c)).To(Succeed())
+			Expect(c.Listen).To(Equal(":9001"))
+			Expect(c.PollInterval).To(Equal(5 * time.Second))
+			Expect(c.MaxBody).To(Equal(int64(10 << 20)))
+			Expect(c.Origins).To(Equal([]string{"c.com"}))
+			Expect(c.DB.Conns).To(Equal(8))
+		})
+
+		It("names every missing and invalid key", func() {
+			apid.Config().Set("invalid_poll_interval", "soon")
+			apid.Config().Set("invalid_db_max_conns", "many")
+
+			var c pluginConfig
+			err := apid.Config().Unmarshal("invalid_", &c)
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*apid.ConfigError).Invalid).To(ConsistOf(
+				"invalid_listen: required",
+				"invalid_poll_interval: invalid duration 'soon'",
+				"invalid_db_max_conns: invalid integer 'many'",
+			))
+		})
+
+		It("notifies listeners of changed prefixes on reload", func() {
+			var changed, other int
+			apid.Config().OnChange("notify.", func() { changed++ })
+			apid.Config().OnChange("other.", func() { other++ })
+
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: one\nnotify:\n  listen: x\n"), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+			Expect(changed).To(Equal(1))
+			Expect(other).To(BeZero())
+		})
+	})
+
+	Context("flags", func() {
+
+		BeforeEach(func() {
+			apid.Config().Register(
+				apid.ConfigKey{Key: "flag_listen", Default: ":9000", Description: "listen address"},
+				apid.ConfigKey{Key: "flag_debug", Type: apid.ConfigTypeBool},
+				apid.ConfigKey{Key: "flag_wait", Type: apid.ConfigTypeDuration, Default: time.Second},
+			)
+		})
+
+		AfterEach(func() {
+			unsetEnv("APID_FLAG_LISTEN")
+		})
+
+		It("generates typed flags for registered keys", func() {
+			flags := config.Flags(apid.Config())
+			Expect(flags.Lookup("flag_listen").DefValue).To(Equal(":9000"))
+			Expect(flags.Lookup("flag_listen").Usage).To(Equal("listen address"))
+			Expect(flags.Lookup("flag_debug").Value.Type()).To(Equal("bool"))
+			Expect(flags.Lookup("flag_wait").Value.Type()).To(Equal("duration"))
+			Expect(flags.Parse([]string{"--flag_wait=soon"})).NotTo(Succeed())
+		})
+
+		It("override env, file and defaults", func() {
+			setEnv("APID_FLAG_LISTEN", ":9002")
+			flags := config.Flags(apid.Config())
+			Expect(flags.Parse([]string{"--flag_listen=:9001", "--flag_wait", "5s"})).To(Succeed())
+			Expect(config.BindFlags(apid.Config(), flags)).To(Succeed())
+
+			Expect(apid.Config().GetString("flag_listen")).To(Equal(":9001"))
+			Expect(apid.Config().Source("flag_listen")).To(Equal(apid.ConfigSourceFlag))
+			Expect(apid.Config().GetDuration("flag_wait")).To(Equal(5 * time.Second))
+			Expect(apid.Config().GetBool("flag_debug")).To(BeFalse())
+			Expect(apid.Config().Source("flag_debug")).To(Equal(apid.ConfigSourceNone))
+			Expect(apid.Config().IsSet("flag_debug")).To(BeFalse())
+		})
+
+		It("binds flags of the flag package", func() {
+			goFlags := flag.NewFlagSet("test", flag.ContinueOnError)
+			goFlags.String("flag_go", "", "")
+			flags := config.Flags(apid.Config())
+			flags.AddGoFlagSet(goFlags)
+			Expect(flags.Parse([]string{"--flag_go=value"})).To(Succeed())
+			Expect(config.BindFlags(apid.Config(), flags)).To(Succeed())
+			Expect(apid.Config().GetString("flag_go")).To(Equal("value"))
+		})
+
+		It("binds flags of keys registered later", func() {
+			defer apid.Config().Register(apid.ConfigKey{Key: "flag_never"})
+			flags := config.Flags(apid.Config())
+			Expect(config.ParseFlags(flags, []string{"--flag_late=5s", "--flag_never=x", "--flag_wait", "2s"})).
+				To(Succeed())
+			Expect(config.BindFlags(apid.Config(), flags)).To(Succeed())
+			Expect(apid.Config().GetDuration("flag_wait")).To(Equal(2 * time.Second))
+
+			err := apid.Config().Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*apid.ConfigError).Unknown).To(ContainElement("flag_late"))
+
+			apid.Config().Register(apid.ConfigKey{Key: "flag_late", Type: apid.ConfigTypeDuration})
+			Expect(apid.Config().GetDuration("flag_late")).To(Equal(5 * time.Second))
+			Expect(apid.Config().Source("flag_late")).To(Equal(apid.ConfigSourceFlag))
+			err = apid.Config().Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*apid.ConfigError).Unknown).To(ConsistOf("flag_never"))
+
+			// only --key=value
+			Expect(config.ParseFlags(config.Flags(apid.Config()), []string{"--flag_other", "x"})).NotTo(Succeed())
+		})
+	})
+
+	Context("typed values in the config file", func() {
+
+		AfterEach(func() {
+			Expect(ioutil.WriteFile(configFile, []byte("reload_test: one\n"), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+		})
+
+		It("are read like env values", func() {
+			Expect(ioutil.WriteFile(configFile, []byte(`reload_test: one
+typed_hosts: [a.com, b.com]
+typed_headers:
+  x-a: 1
+  x-b: 2
+typed_size: 1kb
+typed_bytes: 2048
+typed_big: 8589934592
+typed_time: 2017-06-01T10:00:00Z
+`), 0600)).To(Succeed())
+			Expect(apid.Config().(*config.ConfigMgr).Reload()).To(Succeed())
+
+			Expect(apid.Config().GetStringSlice("typed_hosts")).To(Equal([]string{"a.com", "b.com"}))
+			Expect(apid.Config().GetStringMapString("typed_headers")).To(Equal(map[string]string{"x-a": "1", "x-b": "2"}))
+			Expect(apid.Config().GetStringMap("typed_headers")).To(HaveKeyWithValue("x-a", 1))
+			Expect(apid.Config().GetSizeInBytes("typed_size")).To(Equal(uint(1024)))
+			Expect(apid.Config().GetSizeInBytes("typed_bytes")).To(Equal(uint(2048)))
+			Expect(apid.Config().GetInt64("typed_big")).To(Equal(int64(8589934592)))
+			Expect(apid.Config().GetTime("typed_time")).To(Equal(time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC)))
+		})
 	})
 })
@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cast"
+	"gopkg.in/yaml.v2"
+)
+
+// Env vars only hold strings, so lists and maps are parsed from them with the same meaning as in the config file:
+//   [a, b] or {a: 1}   YAML (or JSON) flow syntax
+//   a, b               comma separated list
+//   a=1, b=2           comma separated map entries
+
+// list of a YAML list or of an env var
+func toStringSlice(value interface{}) []string {
+	s, ok := value.(string)
+	if !ok {
+		return cast.ToStringSlice(value)
+	}
+	if strings.HasPrefix(strings.TrimSpace(s), "[") {
+		var values []interface{}
+		if err := yaml.Unmarshal([]byte(s), &values); err == nil {
+			return cast.ToStringSlice(values)
+		}
+	}
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func toStringMapE(value interface{}) (map[string]interface{}, error) {
+	if value == nil {
+		return map[string]interface{}{}, nil
+	}
+	m := make(map[string]interface{})
+	s, ok := value.(string)
+	if !ok {
+		values, ok := toMap(value)
+		if !ok {
+			return nil, fmt.Errorf("invalid map '%v'", value)
+		}
+		// the config is shared
+		for k, v := range values {
+			m[k] = v
+		}
+		return m, nil
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(s), "{") {
+		var parsed map[interface{}]interface{}
+		if err := yaml.Unmarshal([]byte(s), &parsed); err != nil {
+			return nil, fmt.Errorf("invalid map '%s'", s)
+		}
+		for k, v := range parsed {
+			m[strings.ToLower(cast.ToString(k))] = v
+		}
+		return m, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid map entry '%s'", entry)
+		}
+		m[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	return m, nil
+}
+
+// sizes are integers of bytes or strings with a unit, see parseSize
+func toSizeE(value interface{}) (int64, error) {
+	if s, ok := value.(string); ok {
+		return parseSize(s)
+	}
+	n, err := cast.ToInt64E(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%v'", value)
+	}
+	return n, nil
+}
+
+// parses sizes like "512", "64kb", "10MB" or "1 GB", with 1024 based units
+func parseSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}, {"b", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size '%s' overflows", s)
+	}
+	return n * multiplier, nil
+}
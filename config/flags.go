@@ -0,0 +1,128 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/apid/apid-core"
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+)
+
+// marks the flags ParseFlags added for keys not registered yet
+const unregisteredFlag = "apid_unregistered"
+
+// Flags generates a flag for each key registered with c so far, typed after the key:
+//
+//	flags := config.Flags(apid.Config())
+//	flags.AddGoFlagSet(flag.CommandLine) // to also parse flags of the flag package
+//	if err := config.ParseFlags(flags, os.Args[1:]); err != nil { ... }
+//	config.BindFlags(apid.Config(), flags)
+//
+// Keys registered later, eg. by plugins, have no flag: see ParseFlags. Other ConfigService implementations get a
+// string flag per key with a value.
+func Flags(c apid.ConfigService) *pflag.FlagSet {
+	if m, ok := c.(*ConfigMgr); ok {
+		return m.Flags()
+	}
+	flags := pflag.NewFlagSet("apid", pflag.ContinueOnError)
+	for _, key := range c.AllKeys() {
+		flags.String(key, "", "")
+	}
+	return flags
+}
+
+// ParseFlags parses args like flags.Parse, adding a string flag for each --key=value whose key has no flag, so that
+// keys registered later, eg. by plugins during initialization, can be set from the command line. Their values are
+// checked once registered, and they're reported as unknown if never registered, see apid.InitializePlugins.
+func ParseFlags(flags *pflag.FlagSet, args []string) error {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "--") || !strings.Contains(arg, "=") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)[0]
+		if name != "" && flags.Lookup(name) == nil {
+			flags.String(name, "", "")
+			flags.SetAnnotation(name, unregisteredFlag, nil)
+		}
+	}
+	return flags.Parse(args)
+}
+
+// BindFlags overrides the keys of c with the flags given on the command line, see ConfigMgr.BindFlags.
+// Other ConfigService implementations Set them.
+func BindFlags(c apid.ConfigService, flags *pflag.FlagSet) error {
+	if m, ok := c.(*ConfigMgr); ok {
+		return m.BindFlags(flags)
+	}
+	if !flags.Parsed() {
+		return errors.New("flags must be parsed before binding")
+	}
+	flags.Visit(func(f *pflag.Flag) {
+		c.Set(f.Name, f.Value.String())
+	})
+	return nil
+}
+
+// Flags generates a flag for each key registered so far, see Flags
+func (c *ConfigMgr) Flags() *pflag.FlagSet {
+	c.Lock()
+	defer c.Unlock()
+	flags := pflag.NewFlagSet("apid", pflag.ContinueOnError)
+	for _, key := range c.sortedKeys() {
+		k := c.keys[key]
+		def := k.Default
+		if k.Secret {
+			def = nil
+		}
+		switch k.Type {
+		case apid.ConfigTypeBool:
+			flags.Bool(key, cast.ToBool(def), k.Description)
+		case apid.ConfigTypeInt:
+			flags.Int64(key, cast.ToInt64(def), k.Description)
+		case apid.ConfigTypeFloat:
+			flags.Float64(key, cast.ToFloat64(def), k.Description)
+		case apid.ConfigTypeDuration:
+			flags.Duration(key, cast.ToDuration(def), k.Description)
+		default:
+			flags.String(key, cast.ToString(def), k.Description)
+		}
+	}
+	return flags
+}
+
+// BindFlags binds the flags given on the command line, the flags left out don't override other sources.
+// Flags of any parsed set are bound, not only those generated by Flags().
+func (c *ConfigMgr) BindFlags(flags *pflag.FlagSet) error {
+	if !flags.Parsed() {
+		return errors.New("flags must be parsed before binding")
+	}
+	c.Lock()
+	defer c.Unlock()
+	flags.Visit(func(f *pflag.Flag) {
+		key := strings.ToLower(f.Name)
+		c.flags[key] = f
+		if _, ok := f.Annotations[unregisteredFlag]; !ok {
+			c.known[key] = true
+		}
+	})
+	c.publish()
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strings"
+
+	"github.com/apid/apid-core"
+)
+
+// key names that hold secrets. keys registered as Secret are also secret.
+var secretNames = []string{"passwd", "password", "secret", "token", "credential"}
+
+func (c *ConfigMgr) AllKeys() []string {
+	return append([]string(nil), c.load().keys...)
+}
+
+func (c *ConfigMgr) AllSettings() map[string]interface{} {
+	return c.load().values()
+}
+
+func (c *ConfigMgr) Source(key string) apid.ConfigSource {
+	return c.lookup(key).source
+}
+
+func (c *ConfigMgr) SourceFile(key string) string {
+	return c.lookup(key).file
+}
+
+func (c *ConfigMgr) IsSecret(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.isSecret(key)
+}
+
+// must hold lock
+func (c *ConfigMgr) isSecret(key string) bool {
+	key = strings.ToLower(key)
+	if c.keys[key].Secret {
+		return true
+	}
+	if strings.HasSuffix(key, "_key") {
+		return true
+	}
+	for _, name := range secretNames {
+		if strings.Contains(key, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// The config is merged from layers of config files, later layers overriding earlier ones:
+// the main config file, the apid_config_files, then the files of apid_config_dir (conf.d style) in lexical order.
+// Maps are merged deeply, so a layer may override a single nested key.
+// Each file is parsed according to its extension (YAML, JSON, TOML or HCL), or as apid_config_type if it has none.
+
+const (
+	configFilesKey = "apid_config_files"
+	configDirKey   = "apid_config_dir"
+	configTypeKey  = "apid_config_type"
+)
+
+// config file formats by extension
+var configFileTypes = map[string]string{
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".json": "json",
+	".toml": "toml",
+	".hcl":  "hcl",
+}
+
+type layer struct {
+	file     string
+	settings map[string]interface{}
+}
+
+// reads the config files, must hold lock
+func (c *ConfigMgr) readLayers() ([]string, []layer, []error) {
+	files := c.layerFiles()
+	layers, errs := readLayers(files, c.configType())
+	return files, layers, errs
+}
+
+// format of config files without a known extension
+func (c *ConfigMgr) configType() string {
+	return cast.ToString(c.get(configTypeKey))
+}
+
+// config files in merge order
+func (c *ConfigMgr) layerFiles() []string {
+	var files []string
+	if c.file != "" {
+		files = append(files, c.file)
+	}
+	files = append(files, toStringSlice(c.get(configFilesKey))...)
+	if dir := cast.ToString(c.get(configDirKey)); dir != "" {
+		files = append(files, dirFiles(dir)...)
+	}
+	return files
+}
+
+// config files of the directory in lexical order
+func dirFiles(dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, info := range infos {
+		if !info.IsDir() && isConfigFile(info.Name()) {
+			files = append(files, filepath.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func isConfigFile(name string) bool {
+	return fileType(name) != ""
+}
+
+// format of the file by extension, "" if unknown
+func fileType(name string) string {
+	return configFileTypes[strings.ToLower(filepath.Ext(name))]
+}
+
+// reads the layers, returning the errors of those that couldn't be read or parsed.
+// files without a known extension are read as defaultType.
+func readLayers(files []string, defaultType string) ([]layer, []error) {
+	var layers []layer
+	var errs []error
+	for _, file := range files {
+		typ := fileType(file)
+		if typ == "" {
+			typ = defaultType
+		}
+		l, err := readLayer(file, typ)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("config file '%s': %v", file, err))
+			continue
+		}
+		layers = append(layers, l)
+	}
+	return layers, errs
+}
+
+func readLayer(file, typ string) (layer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return layer{}, err
+	}
+	parsed := viper.New()
+	parsed.SetConfigType(typ)
+	if err := parsed.ReadConfig(bytes.NewReader(data)); err != nil {
+		return layer{}, err
+	}
+	return layer{file: file, settings: parsed.AllSettings()}, nil
+}
+
+// replaces the file config with the merged layers and publishes it, must hold lock
+func (c *ConfigMgr) apply(layers []layer) {
+	merged := make(map[string]interface{})
+	sources := make(map[string]string)
+	for _, l := range layers {
+		deepMerge(merged, l.settings)
+		for _, key := range flatten("", l.settings) {
+			sources[key] = l.file
+		}
+	}
+
+	c.files = merged
+	// a key may have been replaced by a later layer, eg. a map by a value
+	c.fileKeys = make(map[string]string)
+	for _, key := range flatten("", merged) {
+		c.fileKeys[key] = sources[key]
+	}
+	c.publish()
+}
+
+// deep merges src into dst
+func deepMerge(dst, src map[string]interface{}) {
+	for k, sv := range src {
+		if sm, ok := toMap(sv); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				deepMerge(dm, sm)
+				continue
+			}
+			dm := make(map[string]interface{})
+			deepMerge(dm, sm)
+			dst[k] = dm
+			continue
+		}
+		dst[k] = sv
+	}
+}
+
+// leaf keys of the nested map, eg. "a.b"
+func flatten(prefix string, m map[string]interface{}) []string {
+	var keys []string
+	for k, v := range m {
+		if sm, ok := toMap(v); ok && len(sm) > 0 {
+			keys = append(keys, flatten(prefix+k+".", sm)...)
+		} else {
+			keys = append(keys, prefix+k)
+		}
+	}
+	return keys
+}
+
+// YAML decodes nested maps as map[interface{}]interface{}
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		return cast.ToStringMap(m), true
+	}
+	return nil, false
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/apid/apid-core"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cast"
+)
+
+const (
+	configWatchKey = "apid_config_watch"
+
+	// editors and config management write files in several steps, wait for changes to settle
+	watchDelay = 100 * time.Millisecond
+)
+
+// Reload re-reads the config files, if any, and env. The new content is applied atomically: if a file can't be
+// read or parsed, the current config is kept and an error returned.
+// If any value changed, an apid.ConfigChangedEvent listing the changed keys is emitted on
+// apid.ConfigChangedSelector.
+func (c *ConfigMgr) Reload() error {
+	c.Lock()
+	// validate before touching the live config
+	files, layers, errs := c.readLayers()
+	if len(errs) > 0 {
+		c.Unlock()
+		return errs[0]
+	}
+
+	before := c.load().values()
+	c.env = environ()
+	// re-resolve secrets, eg. rotated secret files
+	c.secrets = make(map[string]resolvedSecret)
+	c.apply(layers)
+	after := c.load().values()
+	c.Unlock()
+
+	changed := changedKeys(before, after)
+	if len(changed) == 0 {
+		return nil
+	}
+	if len(files) == 0 {
+		log.Printf("Config reloaded from env, changed keys: %v", changed)
+	} else {
+		log.Printf("Config files %v reloaded, changed keys: %v", files, changed)
+	}
+	c.notifyChanged(changed)
+	emitChanged(changed)
+	return nil
+}
+
+// values of the keys with a value
+func (s *snapshot) values() map[string]interface{} {
+	m := make(map[string]interface{}, len(s.keys))
+	for _, k := range s.keys {
+		m[k] = s.settings[k].value
+	}
+	return m
+}
+
+func changedKeys(before, after map[string]interface{}) []string {
+	var changed []string
+	for k, v := range after {
+		if old, ok := before[k]; !ok || !reflect.DeepEqual(old, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// events may not be available yet during initialization
+func emitChanged(keys []string) {
+	services := apid.AllServices()
+	if services == nil || services.Events() == nil {
+		return
+	}
+	services.Events().Emit(apid.ConfigChangedSelector, apid.ConfigChangedEvent{
+		Description: "config changed",
+		Keys:        keys,
+	})
+}
+
+// reloads the config files when they change, and the config on SIGHUP.
+// directories are watched to pick up atomic saves, symlink swaps (eg. Kubernetes ConfigMaps) and
+// files added to apid_config_dir.
+func (c *ConfigMgr) watch() {
+	files := c.layerFiles()
+	confDir := cast.ToString(c.get(configDirKey))
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// watched files and their symlink targets
+	watched := make(map[string]string)
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		file = filepath.Clean(file)
+		watched[file], _ = filepath.EvalSymlinks(file)
+		dirs[filepath.Dir(file)] = true
+	}
+	if confDir != "" {
+		confDir = filepath.Clean(confDir)
+		dirs[confDir] = true
+	}
+
+	// nil channels if there's nothing to watch: env and defaults are reloaded on SIGHUP only
+	var events chan fsnotify.Event
+	var errs chan error
+	if len(dirs) > 0 {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			for dir := range dirs {
+				if err = watcher.Add(dir); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("Unable to watch config files, reload on SIGHUP only: %s", err)
+		} else {
+			events, errs = watcher.Events, watcher.Errors
+		}
+	}
+
+	reload := func() {
+		if err := c.Reload(); err != nil {
+			log.Printf("Error reloading config, keeping current config: %s", err)
+		}
+	}
+
+	// whether the event changes a config file
+	changed := func(event fsnotify.Event) bool {
+		name := filepath.Clean(event.Name)
+		if _, ok := watched[name]; ok && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove) != 0 {
+			return true
+		}
+		if confDir != "" && filepath.Dir(name) == confDir && isConfigFile(name) {
+			return true
+		}
+		symlinked := false
+		for file, target := range watched {
+			if current, _ := filepath.EvalSymlinks(file); current != "" && current != target {
+				watched[file] = current
+				symlinked = true
+			}
+		}
+		return symlinked
+	}
+
+	settle := time.NewTimer(watchDelay)
+	settle.Stop()
+	go func() {
+		for {
+			select {
+			case <-hup:
+				reload()
+			case event := <-events:
+				if changed(event) {
+					settle.Reset(watchDelay)
+				}
+			case <-settle.C:
+				reload()
+			case err := <-errs:
+				log.Printf("Error watching config files: %s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,261 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/apid/apid-core"
+	"github.com/spf13/cast"
+)
+
+var configKeys = []apid.ConfigKey{
+	{
+		Key:         configPathKey,
+		Type:        apid.ConfigTypeString,
+		Default:     defaultConfigPath,
+		Description: "directory searched for the config file",
+	},
+	{
+		Key:         configFileNameKey,
+		Type:        apid.ConfigTypeString,
+		Default:     defaultConfigFilename,
+		Description: "name of the config file",
+	},
+	{
+		Key:         localStoragePathKey,
+		Type:        apid.ConfigTypeString,
+		Default:     localStoragePathDefault,
+		Description: "directory for local data",
+		Required:    true,
+	},
+	{
+		Key:         configFilesKey,
+		Description: "config files merged over the main config file, in order",
+	},
+	{
+		Key:         configDirKey,
+		Type:        apid.ConfigTypeString,
+		Description: "directory of config files merged last, in lexical order",
+	},
+	{
+		Key:         configTypeKey,
+		Type:        apid.ConfigTypeString,
+		Default:     configFileType,
+		Description: "format of config files without a known extension",
+		Enum:        []string{"yaml", "json", "toml", "hcl"},
+	},
+	{
+		Key:         secretsKeyFileKey,
+		Type:        apid.ConfigTypeString,
+		Description: "file holding the base64 AES key that decrypts enc: values",
+	},
+	{
+		Key:         configWatchKey,
+		Type:        apid.ConfigTypeBool,
+		Default:     true,
+		Description: "reload the config file when it changes",
+	},
+}
+
+// registering a key again keeps the attributes of the earlier registration the new one leaves empty
+func (c *ConfigMgr) Register(keys ...apid.ConfigKey) {
+	c.Lock()
+	defer c.Unlock()
+	for _, k := range keys {
+		k.Key = strings.ToLower(k.Key)
+		if prev, ok := c.keys[k.Key]; ok {
+			k = merge(prev, k)
+		}
+		c.keys[k.Key] = k
+		c.known[k.Key] = true
+		if k.Default != nil {
+			c.defaults[k.Key] = k.Default
+		}
+	}
+	c.publish()
+}
+
+func (c *ConfigMgr) Validate() error {
+	c.Lock()
+	e := &apid.ConfigError{}
+	for _, key := range c.sortedKeys() {
+		if err := checkValue(c.keys[key], c.get(key)); err != nil {
+			if c.isSecret(key) {
+				// the error may contain the value
+				err = errors.New("invalid value")
+			}
+			e.Invalid = append(e.Invalid, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	s := c.load()
+	keyFile := cast.ToString(s.settings[secretsKeyFileKey].value)
+	for _, key := range s.keys {
+		if ref, ok := s.settings[key].raw.(string); ok && c.keys[key].Secret && isSecretRef(ref) {
+			if err := c.secret(key, ref, keyFile).err; err != nil {
+				e.Invalid = append(e.Invalid, fmt.Sprintf("%s: unable to resolve secret: %v", key, err))
+			}
+		}
+	}
+	for key := range c.fileKeys {
+		if !c.known[key] {
+			e.Unknown = append(e.Unknown, key)
+		}
+	}
+	for key := range c.flags {
+		if _, ok := c.fileKeys[key]; !ok && !c.known[key] {
+			e.Unknown = append(e.Unknown, key)
+		}
+	}
+	c.Unlock()
+	sort.Strings(e.Unknown)
+
+	if len(e.Invalid) > 0 || len(e.Unknown) > 0 {
+		return e
+	}
+	return nil
+}
+
+func (c *ConfigMgr) Usage(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	for _, key := range c.sortedKeys() {
+		k := c.keys[key]
+		typ := k.Type
+		if typ == "" {
+			typ = apid.ConfigTypeString
+		}
+		fmt.Fprintf(w, "  %s (%s, env APID_%s, flag --%s)\n", key, typ, strings.ToUpper(key), key)
+		if k.Description != "" {
+			fmt.Fprintf(w, "    \t%s\n", k.Description)
+		}
+		var constraints []string
+		if k.Required {
+			constraints = append(constraints, "required")
+		}
+		if k.Default != nil {
+			constraints = append(constraints, fmt.Sprintf("default: %v", k.Default))
+		}
+		if k.Min != nil {
+			constraints = append(constraints, fmt.Sprintf("min: %v", k.Min))
+		}
+		if k.Max != nil {
+			constraints = append(constraints, fmt.Sprintf("max: %v", k.Max))
+		}
+		if len(k.Enum) > 0 {
+			constraints = append(constraints, "one of: "+strings.Join(k.Enum, ", "))
+		}
+		if len(constraints) > 0 {
+			fmt.Fprintf(w, "    \t(%s)\n", strings.Join(constraints, ", "))
+		}
+	}
+}
+
+func merge(prev, k apid.ConfigKey) apid.ConfigKey {
+	if k.Type == "" {
+		k.Type = prev.Type
+	}
+	if k.Default == nil {
+		k.Default = prev.Default
+	}
+	if k.Description == "" {
+		k.Description = prev.Description
+	}
+	if k.Min == nil {
+		k.Min = prev.Min
+	}
+	if k.Max == nil {
+		k.Max = prev.Max
+	}
+	if len(k.Enum) == 0 {
+		k.Enum = prev.Enum
+	}
+	k.Required = k.Required || prev.Required
+	k.Secret = k.Secret || prev.Secret
+	return k
+}
+
+// must hold lock
+func (c *ConfigMgr) sortedKeys() []string {
+	keys := make([]string, 0, len(c.keys))
+	for key := range c.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checks a value against the key's type and constraints
+func checkValue(k apid.ConfigKey, value interface{}) error {
+	if value == nil || value == "" {
+		if k.Required {
+			return fmt.Errorf("required")
+		}
+		return nil
+	}
+
+	num, err := convert(k.Type, value)
+	if err != nil {
+		return fmt.Errorf("invalid %s value '%v'", k.Type, value)
+	}
+	if k.Min != nil {
+		if min, err := convert(k.Type, k.Min); err == nil && num < min {
+			return fmt.Errorf("value '%v' is less than %v", value, k.Min)
+		}
+	}
+	if k.Max != nil {
+		if max, err := convert(k.Type, k.Max); err == nil && num > max {
+			return fmt.Errorf("value '%v' is greater than %v", value, k.Max)
+		}
+	}
+
+	if len(k.Enum) > 0 {
+		s := cast.ToString(value)
+		for _, e := range k.Enum {
+			if strings.EqualFold(s, e) {
+				return nil
+			}
+		}
+		return fmt.Errorf("value '%v' is not one of: %s", value, strings.Join(k.Enum, ", "))
+	}
+	return nil
+}
+
+// converts a value to the type, returning its numeric value for range checks
+func convert(typ apid.ConfigType, value interface{}) (float64, error) {
+	switch typ {
+	case apid.ConfigTypeBool:
+		_, err := cast.ToBoolE(value)
+		return 0, err
+	case apid.ConfigTypeInt:
+		i, err := cast.ToIntE(value)
+		return float64(i), err
+	case apid.ConfigTypeFloat:
+		return cast.ToFloat64E(value)
+	case apid.ConfigTypeDuration:
+		d, err := cast.ToDurationE(value)
+		return float64(d), err
+	case apid.ConfigTypeSize:
+		n, err := toSizeE(value)
+		return float64(n), err
+	default:
+		_, err := cast.ToStringE(value)
+		return 0, err
+	}
+}
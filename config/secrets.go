@@ -0,0 +1,95 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/apid/apid-core/cipher"
+)
+
+// Values of keys registered as Secret may reference secrets instead of holding them:
+//   file:///run/secrets/x  the content of the file, without trailing newlines
+//   enc:<base64>           the AES (ECB, PKCS7 padding) ciphertext, decrypted with the base64 key in the
+//                          apid_secrets_key_file file
+// References are resolved when read, and resolved again when the config is reloaded. Values of other keys are
+// returned as is, eg. file:// URLs. A reference that can't be resolved is logged, reads as "" and fails Validate().
+
+const (
+	secretsKeyFileKey = "apid_secrets_key_file"
+
+	secretFilePrefix = "file://"
+	secretEncPrefix  = "enc:"
+)
+
+type resolvedSecret struct {
+	value string
+	err   error
+}
+
+func isSecretRef(value interface{}) bool {
+	s, ok := value.(string)
+	return ok && (strings.HasPrefix(s, secretFilePrefix) || strings.HasPrefix(s, secretEncPrefix))
+}
+
+// resolves the reference, enc: values with the key in keyFile
+func resolveSecret(ref, keyFile string) (string, error) {
+	if strings.HasPrefix(ref, secretFilePrefix) {
+		data, err := ioutil.ReadFile(strings.TrimPrefix(ref, secretFilePrefix))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	if keyFile == "" {
+		return "", fmt.Errorf("%s not set, unable to decrypt", secretsKeyFileKey)
+	}
+	encodedKey, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encodedKey)))
+	if err != nil {
+		return "", fmt.Errorf("invalid key in %s: %v", keyFile, err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ref, secretEncPrefix))
+	if err != nil {
+		return "", errors.New("invalid base64 ciphertext")
+	}
+	return decrypt(key, ciphertext)
+}
+
+func decrypt(key, ciphertext []byte) (plaintext string, err error) {
+	if len(ciphertext) == 0 || len(ciphertext)%16 != 0 {
+		return "", errors.New("ciphertext is not a multiple of the block size")
+	}
+	aes, err := cipher.CreateAesCipher(key)
+	if err != nil {
+		return "", err
+	}
+	// cipher panics on padding longer than the plaintext, eg. wrong key
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("unable to decrypt, wrong key?")
+		}
+	}()
+	p, err := aes.Decrypt(ciphertext, cipher.ModeEcb, cipher.PaddingPKCS7)
+	return string(p), err
+}
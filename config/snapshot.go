@@ -0,0 +1,181 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/apid/apid-core"
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+)
+
+// Reads don't lock: whenever a source changes (defaults, config files, env, flags or Set()), the effective settings
+// are computed once and published as an immutable snapshot.
+// The env is read when the config is loaded and reloaded, "APID_X" and "apid_x" both set key "x", the lowercase
+// variable winning.
+
+const envPrefix = "apid_"
+
+type setting struct {
+	// secret references resolved
+	value  interface{}
+	raw    interface{}
+	source apid.ConfigSource
+	// config file of the value, if source is apid.ConfigSourceFile
+	file string
+}
+
+type snapshot struct {
+	// by lowercase key, nested keys both as a map and flattened, eg. "a" and "a.b"
+	settings map[string]setting
+	// sorted keys with a value, nested keys flattened
+	keys []string
+}
+
+func (c *ConfigMgr) load() *snapshot {
+	return c.current.Load().(*snapshot)
+}
+
+func (c *ConfigMgr) lookup(key string) setting {
+	return c.load().settings[strings.ToLower(key)]
+}
+
+// value of the key with secret references resolved
+func (c *ConfigMgr) get(key string) interface{} {
+	return c.lookup(key).value
+}
+
+// computes and publishes the settings, must hold lock
+func (c *ConfigMgr) publish() {
+	s := &snapshot{settings: make(map[string]setting)}
+	leaves := make(map[string]bool)
+	add := func(source apid.ConfigSource, key string, value interface{}) {
+		if value == nil {
+			return
+		}
+		expand(key, value, func(key string, value interface{}, leaf bool) {
+			st := setting{value: value, raw: value, source: source}
+			if source == apid.ConfigSourceFile {
+				st.file = c.fileKeys[key]
+			}
+			s.settings[key] = st
+			if leaf {
+				leaves[key] = true
+			}
+		})
+	}
+
+	// lowest precedence first
+	for k, v := range c.defaults {
+		add(apid.ConfigSourceDefault, k, v)
+	}
+	for k, v := range c.files {
+		add(apid.ConfigSourceFile, k, v)
+	}
+	for k, v := range c.env {
+		s.settings[k] = setting{value: v, raw: v, source: apid.ConfigSourceEnv}
+		// like viper, only known keys set in env are listed
+		if c.known[k] {
+			leaves[k] = true
+		}
+	}
+	for k, f := range c.flags {
+		add(apid.ConfigSourceFlag, k, flagValue(f))
+	}
+	for k, v := range c.overrides {
+		add(apid.ConfigSourceSet, k, v)
+	}
+
+	keyFile := cast.ToString(s.settings[secretsKeyFileKey].value)
+	for k, st := range s.settings {
+		if ref, ok := st.raw.(string); ok && c.keys[k].Secret && isSecretRef(ref) {
+			st.value = c.secret(k, ref, keyFile).value
+			s.settings[k] = st
+		}
+	}
+
+	s.keys = make([]string, 0, len(leaves))
+	for k := range leaves {
+		s.keys = append(s.keys, k)
+	}
+	sort.Strings(s.keys)
+	c.current.Store(s)
+}
+
+// calls fn for the key and, if value is a map, for each nested key
+func expand(key string, value interface{}, fn func(key string, value interface{}, leaf bool)) {
+	key = strings.ToLower(key)
+	m, ok := toMap(value)
+	fn(key, value, !ok || len(m) == 0)
+	for k, v := range m {
+		if v != nil {
+			expand(key+"."+k, v, fn)
+		}
+	}
+}
+
+// resolved secret reference, must hold lock
+func (c *ConfigMgr) secret(key, ref, keyFile string) resolvedSecret {
+	if secret, ok := c.secrets[ref]; ok {
+		return secret
+	}
+	value, err := resolveSecret(ref, keyFile)
+	if err != nil {
+		log.Printf("Unable to resolve secret of config key '%s', its value is empty: %s", key, err)
+	}
+	secret := resolvedSecret{value, err}
+	c.secrets[ref] = secret
+	return secret
+}
+
+// config keys set in env
+func environ() map[string]string {
+	env := make(map[string]string)
+	lowercase := make(map[string]string)
+	for _, kv := range os.Environ() {
+		i := strings.Index(kv, "=")
+		if i <= len(envPrefix) || i == len(kv)-1 {
+			continue
+		}
+		name, value := kv[:i], kv[i+1:]
+		switch {
+		case strings.HasPrefix(name, strings.ToUpper(envPrefix)):
+			env[strings.ToLower(name[len(envPrefix):])] = value
+		case strings.HasPrefix(name, envPrefix):
+			lowercase[strings.ToLower(name[len(envPrefix):])] = value
+		}
+	}
+	for k, v := range lowercase {
+		env[k] = v
+	}
+	return env
+}
+
+// like viper, typed flags keep their type
+func flagValue(f *pflag.Flag) interface{} {
+	switch f.Value.Type() {
+	case "int", "int8", "int16", "int32", "int64":
+		return cast.ToInt(f.Value.String())
+	case "bool":
+		return cast.ToBool(f.Value.String())
+	case "stringSlice", "stringArray":
+		return strings.TrimSuffix(strings.TrimPrefix(f.Value.String(), "["), "]")
+	}
+	return f.Value.String()
+}
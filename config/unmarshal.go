@@ -0,0 +1,267 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/apid/apid-core"
+	"github.com/spf13/cast"
+)
+
+const (
+	configTag  = "config"
+	defaultTag = "default"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+type changeListener struct {
+	prefix string
+	fn     func()
+}
+
+// Unmarshal decodes config keys into the fields of a struct:
+//
+//	type pluginConfig struct {
+//	  Listen      string        `config:"listen,required"`
+//	  PollEvery   time.Duration `config:"poll_interval" default:"1m"`
+//	  MaxBody     int64         `config:"max_body,size" default:"10MB"`
+//	  Origins     []string      `config:"allowed_origins"`
+//	  DB          dbConfig      `config:"db"`
+//	}
+//	err := apid.Config().Unmarshal("myplugin_", &cfg) // reads myplugin_listen, myplugin_poll_interval, ...
+//
+// The key of a field is the prefix followed by the config tag name, or the field name in snake case. Use a prefix
+// ending in "." to decode a sub-tree, eg. "myplugin." for "myplugin: {listen: ...}". Fields of nested structs are
+// decoded with the nested prefix, eg. myplugin_db_path.
+// Tag options: "required" fails if the key has no value, "size" parses byte sizes ("10MB") into integer fields,
+// "-" skips the field. Keys without a value take the default tag value.
+func (c *ConfigMgr) Unmarshal(prefix string, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return errors.New("dest must be a pointer to a struct")
+	}
+	c.Lock()
+	defer c.Unlock()
+	e := &apid.ConfigError{}
+	c.decodeStruct(strings.ToLower(prefix), v.Elem(), e)
+	if len(e.Invalid) > 0 {
+		return e
+	}
+	return nil
+}
+
+// OnChange calls fn when a reload changes keys starting with prefix, eg. to Unmarshal them again
+func (c *ConfigMgr) OnChange(prefix string, fn func()) {
+	c.Lock()
+	defer c.Unlock()
+	c.listeners = append(c.listeners, changeListener{strings.ToLower(prefix), fn})
+}
+
+func (c *ConfigMgr) notifyChanged(keys []string) {
+	c.Lock()
+	listeners := c.listeners
+	c.Unlock()
+	for _, l := range listeners {
+		for _, key := range keys {
+			if strings.HasPrefix(key, l.prefix) {
+				l.fn()
+				break
+			}
+		}
+	}
+}
+
+// must hold lock
+func (c *ConfigMgr) decodeStruct(prefix string, v reflect.Value, e *apid.ConfigError) {
+	sep := "_"
+	if strings.HasSuffix(prefix, ".") {
+		sep = "."
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		name, opts := parseTag(f.Tag.Get(configTag))
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = snakeCase(f.Name)
+		}
+		key := prefix + name
+
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct && field.Type() != timeType {
+			c.decodeStruct(key+sep, field, e)
+			continue
+		}
+
+		var value interface{}
+		if raw := c.get(key); raw != nil && raw != "" {
+			value = raw
+		} else if def, ok := f.Tag.Lookup(defaultTag); ok {
+			value = def
+		} else {
+			if opts["required"] {
+				e.Invalid = append(e.Invalid, key+": required")
+			}
+			continue
+		}
+		if err := setField(field, value, opts["size"]); err != nil {
+			if c.isSecret(key) {
+				err = errors.New("invalid value")
+			}
+			e.Invalid = append(e.Invalid, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+}
+
+func setField(field reflect.Value, value interface{}, size bool) error {
+	if field.Type() == timeType {
+		t, err := cast.ToTimeE(value)
+		if err != nil {
+			return fmt.Errorf("invalid time '%v'", value)
+		}
+		field.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if field.Type() == durationType {
+		d, err := cast.ToDurationE(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration '%v'", value)
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		s, err := cast.ToStringE(value)
+		if err != nil {
+			return fmt.Errorf("invalid string '%v'", value)
+		}
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := cast.ToBoolE(value)
+		if err != nil {
+			return fmt.Errorf("invalid bool '%v'", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := toInt64(value, size)
+		if err != nil {
+			return err
+		}
+		if field.OverflowInt(i) {
+			return fmt.Errorf("value '%v' overflows %s", value, field.Type())
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := toInt64(value, size)
+		if err != nil {
+			return err
+		}
+		if i < 0 || field.OverflowUint(uint64(i)) {
+			return fmt.Errorf("value '%v' overflows %s", value, field.Type())
+		}
+		field.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		f, err := cast.ToFloat64E(value)
+		if err != nil {
+			return fmt.Errorf("invalid float '%v'", value)
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported field type %s", field.Type())
+		}
+		field.Set(reflect.ValueOf(toStringSlice(value)))
+	case reflect.Map:
+		if field.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported field type %s", field.Type())
+		}
+		switch field.Type().Elem().Kind() {
+		case reflect.String:
+			m, err := toStringMapE(value)
+			if err != nil {
+				return fmt.Errorf("invalid map '%v'", value)
+			}
+			field.Set(reflect.ValueOf(cast.ToStringMapString(m)))
+		case reflect.Interface:
+			m, err := toStringMapE(value)
+			if err != nil {
+				return fmt.Errorf("invalid map '%v'", value)
+			}
+			field.Set(reflect.ValueOf(m))
+		default:
+			return fmt.Errorf("unsupported field type %s", field.Type())
+		}
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+func toInt64(value interface{}, size bool) (int64, error) {
+	if size {
+		n, err := toSizeE(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size '%v'", value)
+		}
+		return n, nil
+	}
+	i, err := cast.ToInt64E(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer '%v'", value)
+	}
+	return i, nil
+}
+
+func parseTag(tag string) (string, map[string]bool) {
+	parts := strings.Split(tag, ",")
+	opts := make(map[string]bool)
+	for _, opt := range parts[1:] {
+		opts[strings.TrimSpace(opt)] = true
+	}
+	return strings.TrimSpace(parts[0]), opts
+}
+
+// eg. PollInterval -> poll_interval, MaxDBConns -> max_db_conns
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -14,7 +14,11 @@
 
 package apid
 
-import "time"
+import (
+	"io"
+	"strings"
+	"time"
+)
 
 type ConfigService interface {
 	SetDefault(key string, value interface{})
@@ -26,5 +30,104 @@ type ConfigService interface {
 	GetInt(key string) int
 	GetString(key string) string
 	GetDuration(key string) time.Duration
+	GetInt64(key string) int64
+	// lists and maps in env vars are comma separated ("a,b" and "a=1,b=2") or in YAML flow syntax ("[a, b]", "{a: 1}")
+	GetStringSlice(key string) []string
+	GetStringMap(key string) map[string]interface{}
+	GetStringMapString(key string) map[string]string
+	// parses sizes like "512", "64kb", "10MB" or "1GB" with 1024 based units
+	GetSizeInBytes(key string) uint
+	GetTime(key string) time.Time
 	IsSet(key string) bool
+
+	// registers keys for validation and usage output, setting their defaults
+	Register(keys ...ConfigKey)
+	// checks the values of the registered keys and reports keys in the config file or flags that are not known.
+	// returns a *ConfigError.
+	Validate() error
+	// writes a description of the registered keys, eg. for --help
+	Usage(w io.Writer)
+
+	// keys with a value, sorted
+	AllKeys() []string
+	// effective values by key
+	AllSettings() map[string]interface{}
+	// where the effective value of the key comes from
+	Source(key string) ConfigSource
+	// config file providing the effective value of the key, if its source is ConfigSourceFile
+	SourceFile(key string) string
+	// whether the key holds a secret that must not be logged or displayed
+	IsSecret(key string) bool
+
+	// decodes the keys starting with prefix into the fields of the struct dest points to, see ConfigMgr.Unmarshal in the config package.
+	// returns a *ConfigError naming the invalid keys.
+	Unmarshal(prefix string, dest interface{}) error
+	// calls fn when a reload changes keys starting with prefix, eg. to Unmarshal them again
+	OnChange(prefix string, fn func())
+}
+
+type ConfigSource string
+
+const (
+	ConfigSourceNone    ConfigSource = ""
+	ConfigSourceDefault ConfigSource = "default"
+	ConfigSourceFile    ConfigSource = "file"
+	ConfigSourceEnv     ConfigSource = "env"
+	ConfigSourceFlag    ConfigSource = "flag"
+	ConfigSourceSet     ConfigSource = "set"
+)
+
+type ConfigType string
+
+const (
+	ConfigTypeString   ConfigType = "string"
+	ConfigTypeBool     ConfigType = "bool"
+	ConfigTypeInt      ConfigType = "int"
+	ConfigTypeFloat    ConfigType = "float"
+	ConfigTypeDuration ConfigType = "duration"
+	// bytes, as an integer or a string with a unit, eg. 10MB. See ConfigService.GetSizeInBytes.
+	ConfigTypeSize ConfigType = "size"
+)
+
+// ConfigKey describes a config key. Only Key is required.
+type ConfigKey struct {
+	Key         string
+	Type        ConfigType
+	Default     interface{}
+	Description string
+	// inclusive bounds for int, float, duration and size keys, nil for none
+	Min, Max interface{}
+	// allowed values (case insensitive), empty for any
+	Enum     []string
+	Required bool
+	// the value is redacted from config dumps. keys named like passwords, tokens and keys are secret by default.
+	Secret bool
+}
+
+// ConfigError lists invalid values of registered keys and keys in the config file or flags that are not known,
+// ie. neither registered nor given a default
+type ConfigError struct {
+	Invalid []string
+	Unknown []string
+}
+
+func (e *ConfigError) Error() string {
+	var msgs []string
+	if len(e.Invalid) > 0 {
+		msgs = append(msgs, "invalid config: "+strings.Join(e.Invalid, "; "))
+	}
+	if len(e.Unknown) > 0 {
+		msgs = append(msgs, "unknown config keys: "+strings.Join(e.Unknown, ", "))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// published when the config file is reloaded (file change or SIGHUP) and values changed
+const ConfigChangedSelector EventSelector = "config changed"
+
+// use reflect.DeepEqual to compare this type
+type ConfigChangedEvent struct {
+	Description string
+	// changed keys, sorted
+	Keys []string
 }
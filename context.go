@@ -0,0 +1,89 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apid
+
+import "context"
+
+// request-scoped values carried on a context.Context (eg. http.Request.Context())
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	RequestIDField  = "request_id"
+	PrincipalField  = "principal"
+)
+
+type contextKey string
+
+const (
+	requestIDKey contextKey = "request id"
+	loggerKey    contextKey = "logger"
+	principalKey contextKey = "principal"
+)
+
+// ContextWithRequestID returns a copy of ctx carrying the passed request (correlation) ID
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestIDFromContext returns the request ID carried by ctx, or "" if none
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// ContextWithLogger returns a copy of ctx carrying the passed request logger
+func ContextWithLogger(ctx context.Context, log LogService) context.Context {
+	return context.WithValue(ctx, loggerKey, log)
+}
+
+// LogFromContext returns the request logger carried by ctx.
+// If there is none, the base logger is returned tagged with the request ID of ctx (if any).
+func LogFromContext(ctx context.Context) LogService {
+	if ctx != nil {
+		if log, ok := ctx.Value(loggerKey).(LogService); ok {
+			return log
+		}
+	}
+	return LogWithContext(ctx, Log())
+}
+
+// LogWithContext tags the passed logger with the request ID and principal carried by ctx, if any.
+// eg. a plugin module logger: apid.LogWithContext(r.Context(), log).Debugf(...)
+func LogWithContext(ctx context.Context, log LogService) LogService {
+	if id := RequestIDFromContext(ctx); id != "" {
+		log = log.WithField(RequestIDField, id)
+	}
+	if principal := PrincipalFromContext(ctx); principal != "" {
+		log = log.WithField(PrincipalField, principal)
+	}
+	return log
+}
+
+// ContextWithPrincipal returns a copy of ctx carrying the authenticated principal (caller identity)
+func ContextWithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// PrincipalFromContext returns the authenticated principal carried by ctx, or "" if none
+func PrincipalFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	principal, _ := ctx.Value(principalKey).(string)
+	return principal
+}
@@ -0,0 +1,203 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/apid/apid-core"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Backups are consistent copies of a DB made with the SQLite backup API while the DB is in use: the pages are
+// copied in a single step, reading a snapshot of the DB (WAL mode) without blocking its writers.
+
+func (d *dataService) BackupDB(id, version, file string) error {
+	if err := requireSQLite("backup"); err != nil {
+		return err
+	}
+	if err := validIDs(id, version); err != nil {
+		return err
+	}
+	id, version = defaultIDs(id, version)
+	versionedID := VersionedDBID(id, version)
+	if _, err := os.Stat(DBPath(versionedID)); err != nil {
+		return &os.PathError{Op: "backup", Path: versionedID, Err: os.ErrNotExist}
+	}
+	src, err := dataSource(versionedID)
+	if err != nil {
+		return err
+	}
+
+	// written next to the file then renamed, a failed backup doesn't replace the file
+	tmp := file + ".tmp"
+	os.Remove(tmp)
+	if err := backup(tmp, src); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("backup of DB %s: %v", versionedID, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	log.Infof("Backed up DB %s to %s", versionedID, file)
+	return nil
+}
+
+func (d *dataService) RestoreDB(id, version, file string) error {
+	if err := requireSQLite("restore"); err != nil {
+		return err
+	}
+	if err := validIDs(id, version); err != nil {
+		return err
+	}
+	id, version = defaultIDs(id, version)
+	versionedID := VersionedDBID(id, version)
+	if _, err := os.Stat(file); err != nil {
+		return err
+	}
+	if err := createVersion(versionedID, file); err != nil {
+		return fmt.Errorf("restore of DB %s: %v", versionedID, err)
+	}
+	log.Infof("Restored DB %s from %s", versionedID, file)
+	return nil
+}
+
+func (d *dataService) CloneDBVersion(id, fromVersion, toVersion string) (apid.DB, error) {
+	if err := requireSQLite("clone"); err != nil {
+		return nil, err
+	}
+	if err := validIDs(id, fromVersion, toVersion); err != nil {
+		return nil, err
+	}
+	id, fromVersion = defaultIDs(id, fromVersion)
+	_, toVersion = defaultIDs(id, toVersion)
+	from := VersionedDBID(id, fromVersion)
+	if _, err := os.Stat(DBPath(from)); err != nil {
+		return nil, &os.PathError{Op: "clone", Path: from, Err: os.ErrNotExist}
+	}
+	src, err := dataSource(from)
+	if err != nil {
+		return nil, err
+	}
+	to := VersionedDBID(id, toVersion)
+	if err := createVersion(to, src); err != nil {
+		return nil, fmt.Errorf("clone of DB %s to %s: %v", from, to, err)
+	}
+	log.Infof("Cloned DB %s to %s", from, to)
+	return d.dbVersionForID(id, toVersion)
+}
+
+// rejects IDs and versions that would resolve outside of the data path
+func validIDs(ids ...string) error {
+	for _, id := range ids {
+		if strings.Contains(id, "/") || strings.Contains(id, "..") {
+			return fmt.Errorf("invalid DB ID or version: %q", id)
+		}
+	}
+	return nil
+}
+
+// versions being created by createVersion, guarded by dbMapSync
+var creating = make(map[string]bool)
+
+// creates the DB of a new version as a copy of the src data source. The version is reserved while its pages are
+// copied, without holding dbMapSync.
+func createVersion(versionedID, src string) error {
+	dataPath := DBPath(versionedID)
+	dest, err := dataSource(versionedID)
+	if err != nil {
+		return err
+	}
+
+	dbMapSync.Lock()
+	if _, err := os.Stat(dataPath); dbMap[versionedID] != nil || creating[versionedID] || err == nil {
+		dbMapSync.Unlock()
+		return fmt.Errorf("DB %s exists", versionedID)
+	}
+	if err := os.MkdirAll(path.Dir(dataPath), 0700); err != nil {
+		dbMapSync.Unlock()
+		return err
+	}
+	creating[versionedID] = true
+	dbMapSync.Unlock()
+
+	err = backup(dest, src)
+
+	dbMapSync.Lock()
+	defer dbMapSync.Unlock()
+	delete(creating, versionedID)
+	if err != nil {
+		os.RemoveAll(path.Dir(dataPath))
+	}
+	return err
+}
+
+// copies the DB of the src data source to dest
+func backup(dest, src string) error {
+	driver := &sqlite3.SQLiteDriver{}
+	srcConn, err := driver.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	destConn, err := driver.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	b, err := destConn.(*sqlite3.SQLiteConn).Backup("main", srcConn.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		return err
+	}
+	if _, err := b.Step(-1); err != nil {
+		b.Finish()
+		return err
+	}
+	return b.Finish()
+}
+
+// GET <data_backup_path>?id=&version= downloads a backup of the DB, the common DB by default
+func (d *dataService) backupHandler(w http.ResponseWriter, r *http.Request) {
+	id, version := r.URL.Query().Get("id"), r.URL.Query().Get("version")
+	if err := validIDs(id, version); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := ioutil.TempFile(config.GetString("local_storage_path"), "backup")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := d.BackupDB(id, version, f.Name()); err != nil {
+		status := http.StatusInternalServerError
+		if os.IsNotExist(err) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, f.Name())
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/data"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backups", func() {
+	var db apid.DB
+	var version, file string
+
+	BeforeEach(func() {
+		var err error
+		version = time.Now().String()
+		db, err = apid.Data().DBVersionForID("test_backup", version)
+		Expect(err).NotTo(HaveOccurred())
+		setup(db)
+		file = filepath.Join(tmpDir, "backup_"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	})
+
+	AfterEach(func() {
+		apid.Data().ReleaseDBForID("test_backup", version)
+		os.Remove(file)
+	})
+
+	countRows := func(db apid.DB) int {
+		var n int
+		Expect(db.QueryRow(`SELECT count(*) FROM test_2`).Scan(&n)).To(Succeed())
+		return n
+	}
+
+	// counters of the rows written to test_1, in order
+	written := func(db apid.DB) []string {
+		var counters []string
+		rows, err := db.Query(`SELECT counter FROM test_1 ORDER BY id`)
+		Expect(err).NotTo(HaveOccurred())
+		defer rows.Close()
+		for rows.Next() {
+			var counter string
+			Expect(rows.Scan(&counter)).To(Succeed())
+			counters = append(counters, counter)
+		}
+		return counters
+	}
+
+	It("backs up a DB while it's written and restores it into a new version", func() {
+		const writes = 50
+		started := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < writes; i++ {
+				write(db, i)
+				if i == 0 {
+					close(started)
+				}
+			}
+		}()
+		<-started
+		Expect(apid.Data().BackupDB("test_backup", version, file)).To(Succeed())
+		<-done
+		Expect(file).To(BeAnExistingFile())
+		Expect(written(db)).To(HaveLen(writes))
+
+		restored := version + " restored"
+		Expect(apid.Data().RestoreDB("test_backup", restored, file)).To(Succeed())
+		defer apid.Data().ReleaseDBForID("test_backup", restored)
+		rdb, err := apid.Data().DBVersionForID("test_backup", restored)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(countRows(rdb)).To(Equal(count))
+
+		// the backup holds the writes committed when it was taken, in order
+		restoredWrites := written(rdb)
+		Expect(len(restoredWrites)).To(BeNumerically(">=", 1))
+		for i, counter := range restoredWrites {
+			Expect(counter).To(Equal(strconv.Itoa(i)))
+		}
+
+		_, err = rdb.Exec(`INSERT INTO test_2 (counter) VALUES ('restored')`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(countRows(db)).To(Equal(count))
+	})
+
+	It("doesn't restore over an existing version", func() {
+		Expect(apid.Data().BackupDB("test_backup", version, file)).To(Succeed())
+		Expect(apid.Data().RestoreDB("test_backup", version, file)).NotTo(Succeed())
+		Expect(countRows(db)).To(Equal(count))
+	})
+
+	It("fails to back up a DB that doesn't exist", func() {
+		err := apid.Data().BackupDB("test_backup", "none", file)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		Expect(file).NotTo(BeAnExistingFile())
+	})
+
+	It("clones a version into a new one ready for writes", func() {
+		cloned := version + " cloned"
+		cdb, err := apid.Data().CloneDBVersion("test_backup", version, cloned)
+		Expect(err).NotTo(HaveOccurred())
+		defer apid.Data().ReleaseDBForID("test_backup", cloned)
+		same, err := apid.Data().DBVersionForID("test_backup", cloned)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(same).To(BeIdenticalTo(cdb))
+
+		Expect(countRows(cdb)).To(Equal(count))
+		_, err = cdb.Exec(`INSERT INTO test_2 (counter) VALUES ('cloned')`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(countRows(cdb)).To(Equal(count + 1))
+		Expect(countRows(db)).To(Equal(count))
+
+		_, err = apid.Data().CloneDBVersion("test_backup", version, cloned)
+		Expect(err).To(HaveOccurred())
+		_, err = apid.Data().CloneDBVersion("test_backup", "none", version+" none")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("doesn't serve backups without the admin token", func() {
+		apid.Config().Set("api_admin_auth_token", "")
+		defer apid.Config().Set("api_admin_auth_token", "admin")
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/data/backup?id=test_backup&version="+url.QueryEscape(version), nil)
+		apid.API().Router().ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("serves backups on the admin path", func() {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/data/backup?id=test_backup&version="+url.QueryEscape(version), nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		apid.API().Router().ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(ioutil.WriteFile(file, rec.Body.Bytes(), 0600)).To(Succeed())
+
+		restored := version + " downloaded"
+		Expect(apid.Data().RestoreDB("test_backup", restored, file)).To(Succeed())
+		defer apid.Data().ReleaseDBForID("test_backup", restored)
+		rdb, err := apid.Data().DBVersionForID("test_backup", restored)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(countRows(rdb)).To(Equal(count))
+		Expect(data.DBPath(data.VersionedDBID("test_backup", restored))).To(BeAnExistingFile())
+
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest("GET", "/data/backup?id=test_backup&version=none", nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		apid.API().Router().ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+
+		for _, query := range []string{"id=..&version=..", "id=test_backup/" + url.QueryEscape(version) + "&version=..",
+			"id=../../x&version=y"} {
+			rec = httptest.NewRecorder()
+			req = httptest.NewRequest("GET", "/data/backup?"+query, nil)
+			req.Header.Set("Authorization", "Bearer admin")
+			apid.API().Router().ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		}
+		Expect(apid.Data().BackupDB("..", "..", file)).NotTo(Succeed())
+		Expect(apid.Data().RestoreDB("test_backup", "../x", file)).NotTo(Succeed())
+	})
+})
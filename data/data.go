@@ -23,7 +23,6 @@ import (
 	"github.com/apid/apid-core/api"
 	"github.com/apid/apid-core/data/wrap"
 	"github.com/apid/apid-core/logger"
-	"github.com/mattn/go-sqlite3"
 	"os"
 	"path"
 	"reflect"
@@ -37,18 +36,150 @@ const (
 	configDataDriverKey    = "data_driver"
 	configDataSourceKey    = "data_source"
 	configDataPathKey      = "data_path"
+	configTxMaxAttemptsKey = "data_tx_max_attempts"
+	configTxBackoffKey     = "data_tx_retry_backoff"
+	configTxMaxBackoffKey  = "data_tx_retry_max_backoff"
+	configWriteWaitKey     = "data_write_wait_timeout"
+	configBackupPathKey    = "data_backup_path"
+	configGCKeepKey        = "data_gc_keep_versions"
+	configGCIntervalKey    = "data_gc_interval"
+	configJournalModeKey   = "data_journal_mode"
+	configForeignKeysKey   = "data_foreign_keys"
+	configBusyTimeoutKey   = "data_busy_timeout"
+	configSynchronousKey   = "data_synchronous"
+	configCacheSizeKey     = "data_cache_size"
+	configMmapSizeKey      = "data_mmap_size"
+	configTempStoreKey     = "data_temp_store"
+	configDBPragmasKey     = "data_db_pragmas"
 	statCollectionInterval = 10
 	commonDBID             = "common"
 	commonDBVersion        = "base"
 	defaultTraceLevel      = "warn"
+	defaultWriteWait       = 30 * time.Second
 )
 
+var configKeys = []apid.ConfigKey{
+	{
+		Key:         configDataDriverKey,
+		Type:        apid.ConfigTypeString,
+		Default:     "sqlite3",
+		Description: "registered database/sql driver of the DBs",
+		Required:    true,
+	},
+	{
+		Key:         configDataSourceKey,
+		Type:        apid.ConfigTypeString,
+		Description: "data source name template of the DBs, eg. file:{path}, the driver's by default",
+	},
+	{
+		Key:         configDataPathKey,
+		Type:        apid.ConfigTypeString,
+		Default:     "sqlite",
+		Description: "directory of the DBs, relative to local_storage_path",
+		Required:    true,
+	},
+	{
+		Key:         configTxMaxAttemptsKey,
+		Type:        apid.ConfigTypeInt,
+		Default:     5,
+		Description: "attempts of a WithTx transaction while the DB is busy or locked",
+		Min:         1,
+	},
+	{
+		Key:         configTxBackoffKey,
+		Type:        apid.ConfigTypeDuration,
+		Default:     "10ms",
+		Description: "wait before retrying a WithTx transaction, doubled on each attempt",
+	},
+	{
+		Key:         configTxMaxBackoffKey,
+		Type:        apid.ConfigTypeDuration,
+		Default:     "1s",
+		Description: "maximum wait before retrying a WithTx transaction",
+	},
+	{
+		Key:         configWriteWaitKey,
+		Type:        apid.ConfigTypeDuration,
+		Default:     defaultWriteWait,
+		Description: "max wait of a write outside of a transaction for the open transaction, 0 for no limit",
+		Min:         0,
+	},
+	{
+		Key:         configBackupPathKey,
+		Type:        apid.ConfigTypeString,
+		Description: "admin path serving DB backups, eg. /data/backup",
+	},
+	{
+		Key:         configGCKeepKey,
+		Type:        apid.ConfigTypeInt,
+		Default:     0,
+		Description: "versions of each DB ID kept by the GC of stale versions, besides open and current ones. 0 disables the GC",
+		Min:         0,
+	},
+	{
+		Key:         configGCIntervalKey,
+		Type:        apid.ConfigTypeDuration,
+		Default:     "0s",
+		Description: "interval of the GC of stale DB versions, 0 to run it at startup only",
+	},
+	{
+		Key:         configJournalModeKey,
+		Type:        apid.ConfigTypeString,
+		Default:     "WAL",
+		Description: "PRAGMA journal_mode of the DBs",
+		Enum:        []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"},
+	},
+	{
+		Key:         configForeignKeysKey,
+		Type:        apid.ConfigTypeBool,
+		Default:     true,
+		Description: "PRAGMA foreign_keys of the DBs",
+	},
+	{
+		Key:         configBusyTimeoutKey,
+		Type:        apid.ConfigTypeDuration,
+		Default:     "5s",
+		Description: "PRAGMA busy_timeout of the DBs",
+	},
+	{
+		Key:         configSynchronousKey,
+		Type:        apid.ConfigTypeString,
+		Description: "PRAGMA synchronous of the DBs, SQLite's default if not set",
+		Enum:        []string{"OFF", "NORMAL", "FULL", "EXTRA"},
+	},
+	{
+		Key:         configCacheSizeKey,
+		Type:        apid.ConfigTypeInt,
+		Description: "PRAGMA cache_size of the DBs, pages or -KiB, SQLite's default if not set",
+	},
+	{
+		Key:         configMmapSizeKey,
+		Type:        apid.ConfigTypeInt,
+		Description: "PRAGMA mmap_size of the DBs in bytes, SQLite's default if not set",
+		Min:         0,
+	},
+	{
+		Key:         configTempStoreKey,
+		Type:        apid.ConfigTypeString,
+		Description: "PRAGMA temp_store of the DBs, SQLite's default if not set",
+		Enum:        []string{"DEFAULT", "FILE", "MEMORY"},
+	},
+	{
+		Key:         configDBPragmasKey,
+		Description: "PRAGMAs of the DBs of an ID overriding the data_ ones, eg. {myplugin: {synchronous: OFF}}",
+	},
+}
+
 var log, dbTraceLog apid.LogService
 var config apid.ConfigService
 
 type dbMapInfo struct {
 	db     *ApidDb
 	closed chan bool
+	// handles not released yet
+	refs int
+	// the DB is closed and deleted when its last handle is released
+	released bool
 }
 
 var dbMap = make(map[string]*dbMapInfo)
@@ -56,44 +187,131 @@ var dbMapSync sync.RWMutex
 var tagFieldMapper = make(map[reflect.Type]map[string]string)
 
 type ApidDb struct {
-	db    *sql.DB
-	mutex *sync.Mutex
+	// versioned ID
+	id string
+	db *sql.DB
+	// query_only connections of the read-only transactions
+	readers *sql.DB
+	// serializes the transactions that may write
+	mutex txMutex
+	// of the driver when opened
+	dialect dialect
+}
+
+// a mutex that can be waited for with a context
+type txMutex chan struct{}
+
+func newTxMutex() txMutex {
+	return make(txMutex, 1)
+}
+
+func (m txMutex) Lock() {
+	m <- struct{}{}
+}
+
+func (m txMutex) LockContext(ctx context.Context) error {
+	select {
+	case m <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m txMutex) Unlock() {
+	<-m
 }
 
 func (d *ApidDb) Ping() error {
 	return d.db.Ping()
 }
 
+// applies to the reader connections only, the writes use a single connection
 func (d *ApidDb) SetMaxIdleConns(n int) {
-	d.db.SetMaxIdleConns(n)
+	d.readers.SetMaxIdleConns(n)
 }
 
+// applies to the reader connections only, the writes use a single connection
 func (d *ApidDb) SetMaxOpenConns(n int) {
-	d.db.SetMaxOpenConns(n)
+	d.readers.SetMaxOpenConns(n)
 }
 
+// applies to the writer and reader connections
 func (d *ApidDb) SetConnMaxLifetime(du time.Duration) {
 	d.db.SetConnMaxLifetime(du)
+	d.readers.SetConnMaxLifetime(du)
 }
 
 func (d *ApidDb) Prepare(query string) (*sql.Stmt, error) {
-	return d.db.Prepare(query)
+	return d.PrepareContext(context.Background(), query)
+}
+
+// waits for the open transaction like Exec. The statement runs on the writer connection without waiting: don't use
+// it while a transaction is open.
+func (d *ApidDb) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	if err := d.lockWriter(ctx); err != nil {
+		return nil, err
+	}
+	defer d.mutex.Unlock()
+	return d.db.PrepareContext(ctx, query)
 }
 
 func (d *ApidDb) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return d.db.Exec(query, args...)
+	return d.ExecContext(context.Background(), query, args...)
 }
 
+// waits for the open transaction, see lockWriter
+func (d *ApidDb) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := d.lockWriter(ctx); err != nil {
+		return nil, err
+	}
+	defer d.mutex.Unlock()
+	return d.db.ExecContext(ctx, query, args...)
+}
+
+// waits for the open transaction up to data_write_wait_timeout. There's a single writer connection, held by the
+// transaction: Exec called instead of Tx.Exec while it's open would otherwise wait for ever.
+func (d *ApidDb) lockWriter(ctx context.Context) error {
+	timeout := config.GetDuration(configWriteWaitKey)
+	if timeout <= 0 {
+		return d.mutex.LockContext(ctx)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case d.mutex <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return fmt.Errorf("DB %s: write waited %v for the open transaction, Exec called instead of Tx.Exec?",
+			d.id, timeout)
+	}
+}
+
+// queries run on the reader connections, without waiting for the writes
 func (d *ApidDb) Query(query string, args ...interface{}) (*sql.Rows, error) {
-	return d.db.Query(query, args...)
+	return d.readers.Query(query, args...)
+}
+
+func (d *ApidDb) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return d.readers.QueryContext(ctx, query, args...)
 }
 
 func (d *ApidDb) QueryRow(query string, args ...interface{}) *sql.Row {
-	return d.db.QueryRow(query, args...)
+	return d.readers.QueryRow(query, args...)
+}
+
+func (d *ApidDb) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return d.readers.QueryRowContext(ctx, query, args...)
 }
 
 func (d *ApidDb) QueryStructs(dest interface{}, query string, args ...interface{}) error {
-	rows, err := d.db.Query(query, args...)
+	return d.QueryStructsContext(context.Background(), dest, query, args...)
+}
+
+func (d *ApidDb) QueryStructsContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	rows, err := d.readers.QueryContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
@@ -103,33 +321,93 @@ func (d *ApidDb) QueryStructs(dest interface{}, query string, args ...interface{
 }
 
 func (d *ApidDb) Begin() (apid.Tx, error) {
-	d.mutex.Lock()
-	tx, err := d.db.Begin()
+	return d.BeginTx(context.Background(), nil)
+}
+
+// BeginTx waits for the other transactions of the DB to end, or for ctx to be done.
+// Read-only transactions don't wait: they run on the reader connections and read a snapshot of the DB (WAL mode).
+// The transaction is rolled back when ctx is done.
+func (d *ApidDb) BeginTx(ctx context.Context, opts *sql.TxOptions) (apid.Tx, error) {
+	if opts != nil && opts.ReadOnly {
+		return d.beginTx(ctx, d.readers, nil, opts)
+	}
+	if err := d.mutex.LockContext(ctx); err != nil {
+		return nil, err
+	}
+	return d.beginTx(ctx, d.db, d.mutex, opts)
+}
+
+func (d *ApidDb) beginTx(ctx context.Context, db *sql.DB, mutex txMutex, opts *sql.TxOptions) (apid.Tx, error) {
+	// the driver (go-sqlite3 v1.2.0) may interrupt the connection after BEGIN returned if given ctx,
+	// so cancellation is handled here
+	tx, err := db.BeginTx(context.Background(), opts)
 	if err != nil {
-		d.mutex.Unlock()
+		if mutex != nil {
+			mutex.Unlock()
+		}
 		return nil, err
 	}
-	return &Tx{
-		tx:    tx,
-		mutex: d.mutex,
-	}, nil
+	t := &Tx{
+		tx:     tx,
+		mutex:  mutex,
+		closed: make(chan struct{}),
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				t.Rollback()
+			case <-t.closed:
+			}
+		}()
+	}
+	return t, nil
+}
+
+func (d *ApidDb) close() error {
+	err := d.db.Close()
+	if rerr := d.readers.Close(); err == nil {
+		err = rerr
+	}
+	return err
 }
 
+// stats of the writer and reader connections together
 func (d *ApidDb) Stats() sql.DBStats {
-	return d.db.Stats()
+	w, r := d.db.Stats(), d.readers.Stats()
+	return sql.DBStats{
+		MaxOpenConnections: w.MaxOpenConnections + r.MaxOpenConnections,
+		OpenConnections:    w.OpenConnections + r.OpenConnections,
+		InUse:              w.InUse + r.InUse,
+		Idle:               w.Idle + r.Idle,
+		WaitCount:          w.WaitCount + r.WaitCount,
+		WaitDuration:       w.WaitDuration + r.WaitDuration,
+		MaxIdleClosed:      w.MaxIdleClosed + r.MaxIdleClosed,
+		MaxIdleTimeClosed:  w.MaxIdleTimeClosed + r.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  w.MaxLifetimeClosed + r.MaxLifetimeClosed,
+	}
 }
 
 type Tx struct {
-	tx     *sql.Tx
-	mutex  *sync.Mutex
-	closed bool
+	tx *sql.Tx
+	// nil if read-only
+	mutex  txMutex
+	once   sync.Once
+	closed chan struct{}
+}
+
+// releases the DB to the next transaction, once
+func (tx *Tx) close() {
+	tx.once.Do(func() {
+		close(tx.closed)
+		if tx.mutex != nil {
+			tx.mutex.Unlock()
+		}
+	})
 }
 
 func (tx *Tx) Commit() error {
-	if !tx.closed {
-		defer tx.mutex.Unlock()
-		tx.closed = true
-	}
+	defer tx.close()
 	return tx.tx.Commit()
 }
 func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
@@ -157,10 +435,7 @@ func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interfa
 	return tx.tx.QueryRowContext(ctx, query, args...)
 }
 func (tx *Tx) Rollback() error {
-	if !tx.closed {
-		defer tx.mutex.Unlock()
-		tx.closed = true
-	}
+	defer tx.close()
 	return tx.tx.Rollback()
 }
 func (tx *Tx) Stmt(stmt *sql.Stmt) *sql.Stmt {
@@ -171,7 +446,11 @@ func (tx *Tx) StmtContext(ctx context.Context, stmt *sql.Stmt) *sql.Stmt {
 }
 
 func (tx *Tx) QueryStructs(dest interface{}, query string, args ...interface{}) error {
-	rows, err := tx.tx.Query(query, args...)
+	return tx.QueryStructsContext(context.Background(), dest, query, args...)
+}
+
+func (tx *Tx) QueryStructsContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	rows, err := tx.tx.QueryContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
@@ -188,11 +467,50 @@ func CreateDataService() apid.DataService {
 	config.SetDefault("DATA_TRACE_LOG_LEVEL", defaultTraceLevel)
 	dbTraceLog = apid.Log().ForModule("data_trace")
 
-	config.SetDefault(configDataDriverKey, "sqlite3")
-	config.SetDefault(configDataSourceKey, "file:%s")
-	config.SetDefault(configDataPathKey, "sqlite")
+	config.Register(configKeys...)
 
-	return &dataService{}
+	apid.Events().ListenFunc(apid.ConfigChangedSelector, configChanged)
+
+	d := &dataService{}
+	if path := config.GetString(configBackupPathKey); path != "" {
+		log.Infof("DB backups available on path: %s", path)
+		apid.API().HandleAdminFunc(path, d.backupHandler).Methods("GET")
+	}
+	d.startGC()
+	return d
+}
+
+// applies changed connection pool settings to the open DBs
+func configChanged(event apid.Event) {
+	e, ok := event.(apid.ConfigChangedEvent)
+	if !ok {
+		return
+	}
+	poolChanged := false
+	for _, k := range e.Keys {
+		switch k {
+		case api.ConfigDBMaxConns, api.ConfigDBIdleConns, api.ConfigDBConnsTimeout:
+			poolChanged = true
+		}
+	}
+	if !poolChanged {
+		return
+	}
+
+	dbMapSync.RLock()
+	defer dbMapSync.RUnlock()
+	for versionedID, dbm := range dbMap {
+		if dbm != nil && dbm.db != nil {
+			log.Infof("Applying connection pool config to DB: %s", versionedID)
+			setPoolConfig(dbm.db)
+		}
+	}
+}
+
+func setPoolConfig(db *ApidDb) {
+	db.SetMaxOpenConns(config.GetInt(api.ConfigDBMaxConns))
+	db.SetMaxIdleConns(config.GetInt(api.ConfigDBIdleConns))
+	db.SetConnMaxLifetime(time.Duration(config.GetInt(api.ConfigDBConnsTimeout)) * time.Second)
 }
 
 type dataService struct {
@@ -226,17 +544,17 @@ func (d *dataService) DBVersionForID(id, version string) (apid.DB, error) {
 	return d.dbVersionForID(id, version)
 }
 
-// will set DB to close and delete when no more references for commonDBID, provided version
+// closes and deletes the DB of commonDBID, provided version once its handles are released
 func (d *dataService) ReleaseDB(version string) {
 	d.ReleaseDBForID(commonDBID, version)
 }
 
-// will set DB to close and delete when no more references for commonDBID, commonDBVersion
+// closes and deletes the DB of commonDBID, commonDBVersion once its handles are released
 func (d *dataService) ReleaseCommonDB() {
 	d.ReleaseDBForID(commonDBID, commonDBVersion)
 }
 
-// will set DB to close and delete when no more references for any ID
+// closes and deletes the DB of any ID once its handles are released
 func (d *dataService) ReleaseDBForID(id, version string) {
 	versionedID := VersionedDBID(id, version)
 
@@ -244,36 +562,120 @@ func (d *dataService) ReleaseDBForID(id, version string) {
 	defer dbMapSync.Unlock()
 
 	dbm := dbMap[versionedID]
-	if dbm != nil && dbm.db != nil {
-		if strings.EqualFold(config.GetString(logger.ConfigLevel), logrus.DebugLevel.String()) {
-			dbm.closed <- true
-		}
-		log.Warn("SETTING FINALIZER")
-		finalizer := Delete(versionedID)
-		runtime.SetFinalizer(dbm.db, finalizer)
-		dbMap[versionedID] = nil
-	} else {
+	if dbm == nil || dbm.released {
 		log.Errorf("Cannot find DB handle for ver {%s} to release", version)
+		return
 	}
+	dbm.released = true
+	if dbm.refs > 0 {
+		log.Infof("DB %s will be deleted when its %d handles are released", versionedID, dbm.refs)
+		return
+	}
+	closeAndDelete(versionedID, dbm)
+}
 
-	return
+func (d *dataService) AcquireDB(id, version string) (apid.DBHandle, error) {
+	id, version = defaultIDs(id, version)
+	versionedID := VersionedDBID(id, version)
+	db, err := d.dbVersionForID(id, version)
+	if err != nil {
+		return nil, err
+	}
+
+	dbMapSync.Lock()
+	defer dbMapSync.Unlock()
+	// may have been released since opened
+	dbm := dbMap[versionedID]
+	if dbm == nil || dbm.db != db || dbm.released {
+		return nil, fmt.Errorf("DB %s is released", versionedID)
+	}
+	dbm.refs++
+
+	h := &dbHandle{ApidDb: db, versionedID: versionedID}
+	if _, file, line, ok := runtime.Caller(1); ok {
+		h.acquiredAt = fmt.Sprintf("%s:%d", file, line)
+	}
+	runtime.SetFinalizer(h, leaked)
+	return h, nil
+}
+
+// a counted reference to a DB
+type dbHandle struct {
+	*ApidDb
+	versionedID string
+	acquiredAt  string
+	once        sync.Once
+}
+
+func (h *dbHandle) Release() {
+	h.once.Do(func() {
+		runtime.SetFinalizer(h, nil)
+		release(h.versionedID, h.ApidDb)
+	})
+}
+
+// reports handles collected without having been released, their DB is never deleted
+func leaked(h *dbHandle) {
+	log.Errorf("Handle of DB %s acquired at %s was not released", h.versionedID, h.acquiredAt)
+}
+
+func release(versionedID string, db *ApidDb) {
+	dbMapSync.Lock()
+	defer dbMapSync.Unlock()
+
+	dbm := dbMap[versionedID]
+	if dbm == nil || dbm.db != db {
+		log.Errorf("Cannot find DB %s to release handle", versionedID)
+		return
+	}
+	dbm.refs--
+	if dbm.released && dbm.refs == 0 {
+		closeAndDelete(versionedID, dbm)
+	}
 }
 
+// must hold dbMapSync
+func closeAndDelete(versionedID string, dbm *dbMapInfo) {
+	delete(dbMap, versionedID)
+	if dbm.closed != nil {
+		close(dbm.closed)
+	}
+	if err := dbm.db.close(); err != nil {
+		log.Errorf("error closing DB: %v", err)
+	}
+	if err := os.RemoveAll(path.Dir(DBPath(versionedID))); err != nil {
+		log.Errorf("error removing DB files: %v", err)
+	}
+	log.Debugf("Deleted DB %s", versionedID)
+}
+
+// the open DB, opened if needed
 func (d *dataService) dbVersionForID(id, version string) (retDb *ApidDb, err error) {
 
 	var stoplogchan chan bool
 	versionedID := VersionedDBID(id, version)
 
 	dbMapSync.RLock()
-	dbm := dbMap[versionedID]
-	dbMapSync.RUnlock()
-	if dbm != nil && dbm.db != nil {
+	if dbm := dbMap[versionedID]; dbm != nil && !dbm.released {
+		dbMapSync.RUnlock()
 		return dbm.db, nil
 	}
+	dbMapSync.RUnlock()
 
 	dbMapSync.Lock()
 	defer dbMapSync.Unlock()
 
+	// may have been opened or released meanwhile
+	if dbm := dbMap[versionedID]; dbm != nil {
+		if dbm.released {
+			return nil, fmt.Errorf("DB %s is released, waiting for %d handles", versionedID, dbm.refs)
+		}
+		return dbm.db, nil
+	}
+	if creating[versionedID] {
+		return nil, fmt.Errorf("DB %s is being created", versionedID)
+	}
+
 	dataPath := DBPath(versionedID)
 
 	if err = os.MkdirAll(path.Dir(dataPath), 0700); err != nil {
@@ -281,56 +683,62 @@ func (d *dataService) dbVersionForID(id, version string) (retDb *ApidDb, err err
 	}
 
 	log.Infof("LoadDB: %s", dataPath)
-	source := fmt.Sprintf(config.GetString(configDataSourceKey), dataPath)
-	wrappedDriverName := "dd:" + config.GetString(configDataDriverKey)
-	driver := wrap.NewDriver(&sqlite3.SQLiteDriver{}, dbTraceLog)
-	func() {
-		// just ignore the "registered twice" panic
-		defer func() {
-			recover()
-		}()
-		sql.Register(wrappedDriverName, driver)
-	}()
-
-	db, err := sql.Open(wrappedDriverName, source)
-
+	source, err := dataSource(versionedID)
+	if err != nil {
+		log.Errorf("error loading db: %s", err)
+		return
+	}
+	drv, err := openDriver(config.GetString(configDataDriverKey))
+	if err != nil {
+		log.Errorf("error loading db: %s", err)
+		return
+	}
+	dia := currentDialect()
+	sqlite := dia.sqlite
+	hooks, err := connectHooks(id, sqlite)
 	if err != nil {
 		log.Errorf("error loading db: %s", err)
 		return
 	}
+	db := sql.OpenDB(wrap.NewConnector(drv, source, dbTraceLog, hooks...))
 
 	retDb = &ApidDb{
-		db:    db,
-		mutex: &sync.Mutex{},
+		id:      versionedID,
+		db:      db,
+		mutex:   newTxMutex(),
+		dialect: dia,
 	}
 
+	// runs the connect hooks
 	err = db.Ping()
 	if err != nil {
 		log.Errorf("error pinging db: %s", err)
+		db.Close()
 		return
 	}
 
-	sqlString := "PRAGMA journal_mode=WAL;"
-	_, err = db.Exec(sqlString)
-	if err != nil {
-		log.Errorf("error setting journal_mode: %s", err)
+	if err = migrate(retDb, id, versionedID, latestMigration); err != nil {
+		log.Errorf("error migrating db: %s", err)
+		db.Close()
 		return
 	}
 
-	sqlString = "PRAGMA foreign_keys = ON;"
-	_, err = db.Exec(sqlString)
-	if err != nil {
-		log.Errorf("error enabling foreign_keys: %s", err)
-		return
+	if sqlite {
+		readerHooks := append(hooks[:len(hooks):len(hooks)], queryOnly)
+		retDb.readers = sql.OpenDB(wrap.NewReadOnlyConnector(drv, source, dbTraceLog, readerHooks...))
+	} else {
+		retDb.readers = sql.OpenDB(wrap.NewConnector(drv, source, dbTraceLog, hooks...))
 	}
+
 	if strings.EqualFold(config.GetString(logger.ConfigLevel),
 		logrus.DebugLevel.String()) {
 		stoplogchan = logDBInfo(versionedID, db)
 	}
 
-	db.SetMaxOpenConns(config.GetInt(api.ConfigDBMaxConns))
-	db.SetMaxIdleConns(config.GetInt(api.ConfigDBIdleConns))
-	db.SetConnMaxLifetime(time.Duration(config.GetInt(api.ConfigDBConnsTimeout)) * time.Second)
+	// a single writer: writes outside of transactions wait for the transaction instead of competing for the lock
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	setPoolConfig(retDb)
 	dbInfo := dbMapInfo{
 		db:     retDb,
 		closed: stoplogchan,
@@ -339,19 +747,15 @@ func (d *dataService) dbVersionForID(id, version string) (retDb *ApidDb, err err
 	return
 }
 
-func Delete(versionedID string) interface{} {
-	return func(db *ApidDb) {
-		err := db.db.Close()
-		if err != nil {
-			log.Errorf("error closing DB: %v", err)
-		}
-		dataDir := path.Dir(DBPath(versionedID))
-		err = os.RemoveAll(dataDir)
-		if err != nil {
-			log.Errorf("error removing DB files: %v", err)
-		}
-		delete(dbMap, versionedID)
+// the common ID and the base version for ""
+func defaultIDs(id, version string) (string, string) {
+	if id == "" {
+		id = commonDBID
+	}
+	if version == "" {
+		version = commonDBVersion
 	}
+	return id, version
 }
 
 func VersionedDBID(id, version string) string {
@@ -0,0 +1,113 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_test
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/factory"
+)
+
+// go test -run NONE -bench . ./data/
+
+// a DB with rows to read, written to by a sync writer until the benchmark ends
+func benchDB(b *testing.B) (apid.DB, func()) {
+	if tmpDir == "" {
+		apid.Initialize(factory.DefaultServicesFactory())
+	}
+	dir, err := ioutil.TempDir("", "apid_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	apid.Config().Set("local_storage_path", dir)
+	version := time.Now().String()
+	db, err := apid.Data().DBVersionForID("bench", version)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := db.Exec(setupSql); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := db.Exec(`INSERT INTO test_2 (counter) VALUES (?)`, strconv.Itoa(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			tx, err := db.Begin()
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			tx.Exec(`INSERT INTO test_1 (counter) VALUES (?)`, strconv.Itoa(i))
+			// a sync write
+			time.Sleep(time.Millisecond)
+			tx.Commit()
+		}
+	}()
+
+	b.ResetTimer()
+	return db, func() {
+		b.StopTimer()
+		close(stop)
+		<-stopped
+		apid.Data().ReleaseDBForID("bench", version)
+		os.RemoveAll(dir)
+	}
+}
+
+func benchReadTx(b *testing.B, opts *sql.TxOptions) {
+	db, done := benchDB(b)
+	defer done()
+	b.RunParallel(func(pb *testing.PB) {
+		var numRows int
+		for pb.Next() {
+			tx, err := db.BeginTx(context.Background(), opts)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if err := tx.QueryRow(`SELECT count(*) FROM test_2`).Scan(&numRows); err != nil {
+				b.Error(err)
+			}
+			tx.Commit()
+		}
+	})
+}
+
+func BenchmarkReadTx(b *testing.B) {
+	benchReadTx(b, nil)
+}
+
+func BenchmarkReadOnlyTx(b *testing.B) {
+	benchReadTx(b, &sql.TxOptions{ReadOnly: true})
+}
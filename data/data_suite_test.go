@@ -28,6 +28,8 @@ import (
 var tmpDir string
 
 var _ = BeforeSuite(func() {
+	os.Setenv("APID_DATA_BACKUP_PATH", "/data/backup")
+	os.Setenv("APID_API_ADMIN_AUTH_TOKEN", "admin")
 	apid.Initialize(factory.DefaultServicesFactory())
 
 	var err error
@@ -15,6 +15,7 @@
 package data_test
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/apid/apid-core"
@@ -75,11 +76,94 @@ var _ = Describe("Data Service", func() {
 		Expect(err).NotTo(HaveOccurred())
 		setup(db)
 		id := data.VersionedDBID("release", "version")
-		Expect(db.Stats().OpenConnections).To(Equal(1))
-		// run finalizer
-		data.Delete(id).(func(db *data.ApidDb))(db.(*data.ApidDb))
-		Expect(db.Stats().OpenConnections).To(Equal(0))
+		Expect(data.DBPath(id)).Should(BeAnExistingFile())
+
+		// without handles, closed and deleted now
+		apid.Data().ReleaseDBForID("release", "version")
 		Expect(data.DBPath(id)).ShouldNot(BeAnExistingFile())
+		Expect(db.Ping()).NotTo(Succeed())
+
+		// opens a new one
+		db, err = apid.Data().DBVersionForID("release", "version")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(db.Ping()).To(Succeed())
+		var numTables int
+		Expect(db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'test_2'`).Scan(&numTables)).To(Succeed())
+		Expect(numTables).To(BeZero())
+		apid.Data().ReleaseDBForID("release", "version")
+	})
+
+	Context("handles", func() {
+
+		It("deletes a released DB when its last handle is released", func() {
+			h1, err := apid.Data().AcquireDB("handles", "v1")
+			Expect(err).NotTo(HaveOccurred())
+			h2, err := apid.Data().AcquireDB("handles", "v1")
+			Expect(err).NotTo(HaveOccurred())
+			setup(h1)
+			id := data.VersionedDBID("handles", "v1")
+
+			apid.Data().ReleaseDBForID("handles", "v1")
+			Expect(data.DBPath(id)).Should(BeAnExistingFile())
+			_, err = apid.Data().DBVersionForID("handles", "v1")
+			Expect(err).To(HaveOccurred())
+			_, err = apid.Data().AcquireDB("handles", "v1")
+			Expect(err).To(HaveOccurred())
+
+			h1.Release()
+			h1.Release()
+			Expect(data.DBPath(id)).Should(BeAnExistingFile())
+			var numRows int
+			Expect(h2.QueryRow(`SELECT count(*) FROM test_2`).Scan(&numRows)).To(Succeed())
+			Expect(numRows).To(Equal(count))
+
+			h2.Release()
+			Expect(data.DBPath(id)).ShouldNot(BeAnExistingFile())
+			Expect(h2.Ping()).NotTo(Succeed())
+		})
+
+		It("keeps a DB whose handles are released", func() {
+			h, err := apid.Data().AcquireDB("", "")
+			Expect(err).NotTo(HaveOccurred())
+			common, err := apid.Data().DB()
+			Expect(err).NotTo(HaveOccurred())
+			h.Release()
+			Expect(common.Ping()).To(Succeed())
+		})
+
+		It("acquires and releases concurrently", func() {
+			const workers = 20
+			done := make(chan error, workers)
+			for i := 0; i < workers; i++ {
+				go func() {
+					h, err := apid.Data().AcquireDB("handles", "concurrent")
+					if err == nil {
+						_, err = h.Exec(`CREATE TABLE IF NOT EXISTS t (id INTEGER PRIMARY KEY)`)
+						h.Release()
+					}
+					done <- err
+				}()
+			}
+			for i := 0; i < workers; i++ {
+				Expect(<-done).To(Succeed())
+			}
+
+			id := data.VersionedDBID("handles", "concurrent")
+			h, err := apid.Data().AcquireDB("handles", "concurrent")
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < workers; i++ {
+				go func() {
+					apid.Data().ReleaseDBForID("handles", "concurrent")
+					done <- nil
+				}()
+			}
+			for i := 0; i < workers; i++ {
+				<-done
+			}
+			Expect(data.DBPath(id)).Should(BeAnExistingFile())
+			h.Release()
+			Expect(data.DBPath(id)).ShouldNot(BeAnExistingFile())
+		})
 	})
 
 	It("should handle concurrent read & serialized write, and throttle", func() {
@@ -246,6 +330,173 @@ var _ = Describe("Data Service", func() {
 		}
 	}, 10)
 
+	Context("context", func() {
+		var db apid.DB
+
+		BeforeEach(func() {
+			var err error
+			db, err = apid.Data().DBVersionForID("test_context", time.Now().String())
+			Expect(err).NotTo(HaveOccurred())
+			setup(db)
+		})
+
+		It("passes the context to queries", func() {
+			ctx := context.Background()
+			var numRows int
+			Expect(db.QueryRowContext(ctx, `SELECT count(*) FROM test_2`).Scan(&numRows)).To(Succeed())
+			Expect(numRows).To(Equal(count))
+			_, err := db.ExecContext(ctx, `INSERT INTO test_1 (counter) VALUES ('ctx')`)
+			Expect(err).NotTo(HaveOccurred())
+
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			_, err = db.ExecContext(canceled, `INSERT INTO test_1 (counter) VALUES ('canceled')`)
+			Expect(err).To(Equal(context.Canceled))
+			_, err = db.QueryContext(canceled, `SELECT counter FROM test_1`)
+			Expect(err).To(Equal(context.Canceled))
+			_, err = db.PrepareContext(canceled, `SELECT counter FROM test_1`)
+			Expect(err).To(Equal(context.Canceled))
+			var s []struct {
+				Counter string `db:"counter"`
+			}
+			Expect(db.QueryStructsContext(canceled, &s, `SELECT counter FROM test_1`)).To(Equal(context.Canceled))
+		})
+
+		It("gives up waiting for a transaction when the context is done", func() {
+			tx, err := db.Begin()
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err = db.BeginTx(ctx, nil)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+
+			Expect(tx.Rollback()).To(Succeed())
+			tx, err = db.BeginTx(context.Background(), nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tx.Commit()).To(Succeed())
+		})
+
+		It("rolls back and releases the DB when the context of a transaction is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			tx, err := db.BeginTx(ctx, nil)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = tx.ExecContext(ctx, `INSERT INTO test_1 (counter) VALUES ('rolled back')`)
+			Expect(err).NotTo(HaveOccurred())
+			cancel()
+
+			next := make(chan error, 1)
+			go func() {
+				tx, err := db.Begin()
+				if err == nil {
+					err = tx.Commit()
+				}
+				next <- err
+			}()
+			Eventually(next).Should(Receive(BeNil()))
+			Expect(tx.Commit()).NotTo(Succeed())
+			// the DB isn't released twice
+			tx, err = db.Begin()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = db.BeginTx(ctx, nil)
+			Expect(err).To(Equal(context.Canceled))
+			Expect(tx.Rollback()).To(Succeed())
+
+			var numRows int
+			Expect(db.QueryRow(`SELECT count(*) FROM test_1 WHERE counter = 'rolled back'`).Scan(&numRows)).To(Succeed())
+			Expect(numRows).To(BeZero())
+		})
+	})
+
+	Context("read-only transactions", func() {
+		var db apid.DB
+		readOnly := &sql.TxOptions{ReadOnly: true}
+
+		BeforeEach(func() {
+			var err error
+			db, err = apid.Data().DBVersionForID("test_read_only", time.Now().String())
+			Expect(err).NotTo(HaveOccurred())
+			setup(db)
+		})
+
+		It("reads a snapshot without waiting for the writer", func() {
+			tx, err := db.Begin()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = tx.Exec(`INSERT INTO test_2 (counter) VALUES ('uncommitted')`)
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			ro, err := db.BeginTx(ctx, readOnly)
+			Expect(err).NotTo(HaveOccurred())
+			var numRows int
+			Expect(ro.QueryRow(`SELECT count(*) FROM test_2`).Scan(&numRows)).To(Succeed())
+			Expect(numRows).To(Equal(count))
+
+			Expect(tx.Commit()).To(Succeed())
+			Expect(ro.QueryRow(`SELECT count(*) FROM test_2`).Scan(&numRows)).To(Succeed())
+			Expect(numRows).To(Equal(count))
+			Expect(ro.Commit()).To(Succeed())
+
+			ro, err = db.BeginTx(ctx, readOnly)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ro.QueryRow(`SELECT count(*) FROM test_2`).Scan(&numRows)).To(Succeed())
+			Expect(numRows).To(Equal(count + 1))
+			Expect(ro.Rollback()).To(Succeed())
+		})
+
+		It("runs queries on the readers and writes on a single connection", func() {
+			tx, err := db.Begin()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = tx.Exec(`INSERT INTO test_2 (counter) VALUES ('uncommitted')`)
+			Expect(err).NotTo(HaveOccurred())
+
+			var numRows int
+			Expect(db.QueryRow(`SELECT count(*) FROM test_2`).Scan(&numRows)).To(Succeed())
+			Expect(numRows).To(Equal(count))
+
+			// waits for the transaction instead of failing with SQLITE_BUSY
+			written := make(chan error, 1)
+			go func() {
+				_, err := db.Exec(`INSERT INTO test_2 (counter) VALUES ('after')`)
+				written <- err
+			}()
+			Consistently(written, 200*time.Millisecond).ShouldNot(Receive())
+			Expect(tx.Commit()).To(Succeed())
+			Eventually(written).Should(Receive(BeNil()))
+
+			Expect(db.QueryRow(`SELECT count(*) FROM test_2`).Scan(&numRows)).To(Succeed())
+			Expect(numRows).To(Equal(count + 2))
+			// the writer and a reader
+			Expect(db.Stats().OpenConnections).To(BeNumerically(">=", 2))
+		})
+
+		It("fails a write outside of the open transaction after data_write_wait_timeout", func() {
+			apid.Config().Set("data_write_wait_timeout", 100*time.Millisecond)
+			defer apid.Config().Set("data_write_wait_timeout", 30*time.Second)
+
+			tx, err := db.Begin()
+			Expect(err).NotTo(HaveOccurred())
+			// instead of tx.Exec, would wait for ever for the connection held by tx
+			_, err = db.Exec(`INSERT INTO test_2 (counter) VALUES ('outside')`)
+			Expect(err).To(MatchError(ContainSubstring("Exec called instead of Tx.Exec?")))
+			_, err = db.Prepare(`INSERT INTO test_2 (counter) VALUES ('outside')`)
+			Expect(err).To(HaveOccurred())
+			Expect(tx.Rollback()).To(Succeed())
+
+			_, err = db.Exec(`INSERT INTO test_2 (counter) VALUES ('outside')`)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("can't write", func() {
+			ro, err := db.BeginTx(context.Background(), readOnly)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = ro.Exec(`INSERT INTO test_2 (counter) VALUES ('read-only')`)
+			Expect(err).To(HaveOccurred())
+			Expect(ro.Rollback()).To(Succeed())
+		})
+	})
+
 	Context("StructsFromRows", func() {
 		type TestStruct struct {
 			Id            string          `db:"id"`
@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The DBs are opened with the database/sql driver registered as data_driver, SQLite by default. The data source
+// name of a DB is the data_source template, or the template of the driver, where:
+// {path} (or %s) is replaced by the file path of the DB, {id} and {version} by its ID and version, and {name} by
+// them mapped to an identifier, eg. for a database name.
+// The PRAGMAs, the query_only connections of read-only transactions, backups and clones are SQLite only: other
+// drivers must implement driver.ConnBeginTx for read-only transactions.
+
+type dialect struct {
+	// data source template
+	source string
+	// begins a transaction taking the write lock, BEGIN by default
+	beginWrite string
+	// whether the error is transient, the DB being busy or locked: WithTx retries the transaction
+	busy   func(error) bool
+	sqlite bool
+}
+
+var dialects = map[string]dialect{
+	"sqlite3": {source: "file:{path}", beginWrite: "BEGIN IMMEDIATE", busy: sqliteBusy, sqlite: true},
+}
+
+var nonIdentifier = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// dialect of data_driver
+func currentDialect() dialect {
+	return dialects[config.GetString(configDataDriverKey)]
+}
+
+func (d dialect) begin() string {
+	if d.beginWrite == "" {
+		return "BEGIN"
+	}
+	return d.beginWrite
+}
+
+// the driver registered as name
+func openDriver(name string) (driver.Driver, error) {
+	db, err := sql.Open(name, "")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return db.Driver(), nil
+}
+
+// data source name of the DB
+func dataSource(versionedID string) (string, error) {
+	source := config.GetString(configDataSourceKey)
+	if source == "" {
+		source = currentDialect().source
+	}
+	if source == "" {
+		return "", fmt.Errorf("%s is required by driver %s", configDataSourceKey, config.GetString(configDataDriverKey))
+	}
+	id, version := path.Dir(versionedID), path.Base(versionedID)
+	return strings.NewReplacer(
+		"%s", DBPath(versionedID),
+		"{path}", DBPath(versionedID),
+		"{id}", id,
+		"{version}", version,
+		"{name}", dbName(versionedID),
+	).Replace(source), nil
+}
+
+// eg. "plugin_2017_10_01_3f2a9c1b" for "plugin/2017-10-01", the hash tells apart versions mapped alike
+func dbName(versionedID string) string {
+	name := nonIdentifier.ReplaceAllString(strings.ToLower(versionedID), "_")
+	if len(name) > 40 {
+		name = name[:40]
+	}
+	sum := sha256.Sum256([]byte(versionedID))
+	return name + "_" + hex.EncodeToString(sum[:4])
+}
+
+// fails unless data_driver is SQLite
+func requireSQLite(op string) error {
+	if !currentDialect().sqlite {
+		return errors.New(op + " not supported by driver " + config.GetString(configDataDriverKey))
+	}
+	return nil
+}
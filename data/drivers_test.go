@@ -0,0 +1,166 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"sync"
+
+	"github.com/apid/apid-core"
+	"github.com/mattn/go-sqlite3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// a driver implementing only the required driver interfaces, on top of SQLite. Its data source names are
+// "<name>|<SQLite data source name>".
+type fakeDriver struct {
+	sync.Mutex
+	names []string
+}
+
+func (d *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	name, source := "", dsn
+	if i := strings.Index(dsn, "|"); i >= 0 {
+		name, source = dsn[:i], dsn[i+1:]
+	}
+	d.Lock()
+	d.names = append(d.names, name)
+	d.Unlock()
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(source)
+	if err != nil {
+		return nil, err
+	}
+	return fakeConn{conn}, nil
+}
+
+type fakeConn struct {
+	conn driver.Conn
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return fakeStmt{stmt}, nil
+}
+
+func (c fakeConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return c.conn.Begin()
+}
+
+type fakeStmt struct {
+	stmt driver.Stmt
+}
+
+func (s fakeStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s fakeStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.stmt.Exec(args)
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.stmt.Query(args)
+}
+
+var fake = &fakeDriver{}
+
+func init() {
+	sql.Register("fake", fake)
+}
+
+var _ = Describe("Drivers", func() {
+	const id = "test_drivers"
+
+	BeforeEach(func() {
+		apid.Config().Set("data_driver", "fake")
+		apid.Config().Set("data_source", "{name}|file:{path}")
+	})
+
+	AfterEach(func() {
+		apid.Data().ReleaseDBForID(id, "v1")
+		apid.Config().Set("data_driver", "sqlite3")
+		apid.Config().Set("data_source", "")
+	})
+
+	It("opens the DBs with the configured driver and data source", func() {
+		db, err := apid.Data().DBVersionForID(id, "v1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(db.Ping()).To(Succeed())
+
+		fake.Lock()
+		defer fake.Unlock()
+		Expect(fake.names).To(ContainElement(MatchRegexp(`^test_drivers_v1_[0-9a-f]{8}$`)))
+	})
+
+	It("runs queries, transactions and migrations through the required interfaces", func() {
+		Expect(apid.Data().RegisterMigrations(id,
+			apid.Migration{Version: 1, Up: `CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT);`},
+		)).To(Succeed())
+		db, err := apid.Data().DBVersionForID(id, "v1")
+		Expect(err).NotTo(HaveOccurred())
+
+		ctx := context.Background()
+		_, err = db.ExecContext(ctx, `INSERT INTO items (id, name) VALUES (?, ?)`, 1, "one")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(db.WithTx(ctx, func(tx apid.Tx) error {
+			_, err := tx.ExecContext(ctx, `INSERT INTO items (id, name) VALUES (?, ?)`, 2, "two")
+			return err
+		})).To(Succeed())
+
+		var name string
+		Expect(db.QueryRowContext(ctx, `SELECT name FROM items WHERE id = ?`, 2).Scan(&name)).To(Succeed())
+		Expect(name).To(Equal("two"))
+
+		// the driver can't enforce them
+		_, err = db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+		Expect(err).To(MatchError("sql: driver does not support read-only transactions"))
+
+		_, err = db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+		Expect(err).To(HaveOccurred())
+
+		// the busy errors of the driver aren't known
+		attempts := 0
+		busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+		Expect(db.WithTx(ctx, func(tx apid.Tx) error {
+			attempts++
+			return busy
+		})).To(Equal(busy))
+		Expect(attempts).To(Equal(1))
+	})
+
+	It("rejects the SQLite only operations", func() {
+		_, err := apid.Data().DBVersionForID(id, "v1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(apid.Data().BackupDB(id, "v1", tmpDir+"/drivers.bak")).To(MatchError(ContainSubstring("not supported")))
+		_, err = apid.Data().CloneDBVersion(id, "v1", "v2")
+		Expect(err).To(MatchError(ContainSubstring("not supported")))
+	})
+})
@@ -0,0 +1,249 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apid/apid-core"
+)
+
+// Applied migrations are recorded in the migrationsTable of each DB with the checksum of their Up SQL, an applied
+// migration whose SQL changed fails the DB open. Each migration is applied in its own transaction, taking the SQLite
+// write lock first so that processes sharing the DB don't apply it twice.
+
+const (
+	migrationsTable       = "_apid_migrations"
+	createMigrationsTable = `CREATE TABLE IF NOT EXISTS ` + migrationsTable + ` (
+		version INTEGER PRIMARY KEY,
+		description TEXT,
+		checksum TEXT NOT NULL,
+		applied_at TEXT NOT NULL);`
+	latestMigration = -1
+)
+
+// registered migrations by DB ID, sorted by version
+var migrations = make(map[string][]apid.Migration)
+var migrationsSync sync.Mutex
+
+func (d *dataService) RegisterMigrations(id string, ms ...apid.Migration) error {
+	if id == "" {
+		id = commonDBID
+	}
+
+	migrationsSync.Lock()
+	registered := append(append([]apid.Migration(nil), migrations[id]...), ms...)
+	sort.Slice(registered, func(i, j int) bool {
+		return registered[i].Version < registered[j].Version
+	})
+	for i, m := range registered {
+		if m.Version <= 0 {
+			migrationsSync.Unlock()
+			return fmt.Errorf("migration of DB %s: invalid version %d", id, m.Version)
+		}
+		if i > 0 && registered[i-1].Version == m.Version {
+			migrationsSync.Unlock()
+			return fmt.Errorf("migration of DB %s: duplicate version %d", id, m.Version)
+		}
+		if m.Up == "" {
+			migrationsSync.Unlock()
+			return fmt.Errorf("migration %d of DB %s: no Up SQL", m.Version, id)
+		}
+	}
+	migrations[id] = registered
+	migrationsSync.Unlock()
+
+	open := make(map[string]*ApidDb)
+	dbMapSync.RLock()
+	for versionedID, dbm := range dbMap {
+		if !dbm.released && path.Dir(versionedID) == id {
+			open[versionedID] = dbm.db
+		}
+	}
+	dbMapSync.RUnlock()
+	for versionedID, db := range open {
+		if err := migrate(db, id, versionedID, latestMigration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dataService) MigrateDB(id, version string, target int) error {
+	if id == "" {
+		id = commonDBID
+	}
+	// opening applies the pending migrations
+	db, err := d.dbVersionForID(id, version)
+	if err != nil {
+		return err
+	}
+	return migrate(db, id, VersionedDBID(id, version), target)
+}
+
+func registeredMigrations(id string) []apid.Migration {
+	migrationsSync.Lock()
+	defer migrationsSync.Unlock()
+	return migrations[id]
+}
+
+// migrates the DB to the target version, or latestMigration
+func migrate(db *ApidDb, id, versionedID string, target int) error {
+	ms := registeredMigrations(id)
+	if len(ms) == 0 && target == latestMigration {
+		return nil
+	}
+	if target == latestMigration {
+		target = ms[len(ms)-1].Version
+	}
+
+	// serializes with the writes of this process
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	ctx := context.Background()
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, createMigrationsTable); err != nil {
+		return fmt.Errorf("unable to create %s table: %v", migrationsTable, err)
+	}
+
+	for {
+		done, err := migrateStep(ctx, conn, ms, versionedID, target)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// applies or reverts one migration, returning done if the DB is at the target version
+func migrateStep(ctx context.Context, conn *sql.Conn, ms []apid.Migration, versionedID string,
+	target int) (done bool, err error) {
+
+	// takes the write lock before reading the applied migrations
+	if _, err = conn.ExecContext(ctx, currentDialect().begin()); err != nil {
+		return
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			conn.ExecContext(ctx, "ROLLBACK")
+		}
+	}()
+
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return
+	}
+	byVersion := make(map[int]apid.Migration)
+	for _, m := range ms {
+		byVersion[m.Version] = m
+		if sum, ok := applied[m.Version]; ok && sum != checksum(m) {
+			err = fmt.Errorf("migration %d (%s) of DB %s changed since it was applied", m.Version, m.Description,
+				versionedID)
+			return
+		}
+	}
+
+	var m apid.Migration
+	up := false
+	// first pending migration up to target
+	for _, pending := range ms {
+		if _, ok := applied[pending.Version]; !ok && pending.Version <= target {
+			m, up = pending, true
+			break
+		}
+	}
+	// last applied migration above target
+	if !up {
+		for version := range applied {
+			if version > target && version > m.Version {
+				m = apid.Migration{Version: version}
+			}
+		}
+		if m.Version == 0 {
+			return true, nil
+		}
+		if known, ok := byVersion[m.Version]; ok {
+			m = known
+		}
+		if m.Down == "" {
+			err = fmt.Errorf("migration %d of DB %s can't be reverted, no Down SQL", m.Version, versionedID)
+			return
+		}
+	}
+
+	if up {
+		if _, err = conn.ExecContext(ctx, m.Up); err == nil {
+			_, err = conn.ExecContext(ctx, "INSERT INTO "+migrationsTable+
+				" (version, description, checksum, applied_at) VALUES (?, ?, ?, ?);",
+				m.Version, m.Description, checksum(m), time.Now().UTC().Format(time.RFC3339))
+		}
+	} else {
+		if _, err = conn.ExecContext(ctx, m.Down); err == nil {
+			_, err = conn.ExecContext(ctx, "DELETE FROM "+migrationsTable+" WHERE version = ?;", m.Version)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("migration %d (%s) of DB %s failed: %v", m.Version, m.Description, versionedID, err)
+		return
+	}
+	if _, err = conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return
+	}
+	committed = true
+
+	if up {
+		log.Infof("Applied migration %d (%s) to DB %s", m.Version, m.Description, versionedID)
+	} else {
+		log.Infof("Reverted migration %d (%s) of DB %s", m.Version, m.Description, versionedID)
+	}
+	return false, nil
+}
+
+// checksums by version
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]string, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, checksum FROM "+migrationsTable+";")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var sum string
+		if err := rows.Scan(&version, &sum); err != nil {
+			return nil, err
+		}
+		applied[version] = sum
+	}
+	return applied, rows.Err()
+}
+
+func checksum(m apid.Migration) string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_test
+
+import (
+	"database/sql"
+	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/data"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Migrations", func() {
+
+	tables := func(db apid.DB) []string {
+		var names []string
+		rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name`)
+		Expect(err).NotTo(HaveOccurred())
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			Expect(rows.Scan(&name)).To(Succeed())
+			names = append(names, name)
+		}
+		return names
+	}
+
+	applied := func(db apid.DB) []int {
+		var versions []int
+		rows, err := db.Query(`SELECT version FROM _apid_migrations ORDER BY version`)
+		Expect(err).NotTo(HaveOccurred())
+		defer rows.Close()
+		for rows.Next() {
+			var v int
+			Expect(rows.Scan(&v)).To(Succeed())
+			versions = append(versions, v)
+		}
+		return versions
+	}
+
+	It("applies registered migrations in order when a DB is opened", func() {
+		Expect(apid.Data().RegisterMigrations("migrate_open",
+			apid.Migration{Version: 2, Description: "add name", Up: `ALTER TABLE m1 ADD COLUMN name TEXT;`},
+			apid.Migration{Version: 1, Description: "create", Up: `CREATE TABLE m1 (id INTEGER PRIMARY KEY);`},
+		)).To(Succeed())
+
+		db, err := apid.Data().DBVersionForID("migrate_open", "v1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tables(db)).To(Equal([]string{"_apid_migrations", "m1"}))
+		Expect(applied(db)).To(Equal([]int{1, 2}))
+		_, err = db.Exec(`INSERT INTO m1 (id, name) VALUES (1, 'x')`)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("applies migrations registered later to the open DBs", func() {
+		Expect(apid.Data().RegisterMigrations("migrate_later",
+			apid.Migration{Version: 1, Up: `CREATE TABLE m1 (id INTEGER PRIMARY KEY);`},
+		)).To(Succeed())
+		db, err := apid.Data().DBVersionForID("migrate_later", "v1")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(apid.Data().RegisterMigrations("migrate_later",
+			apid.Migration{Version: 2, Up: `CREATE TABLE m2 (id INTEGER PRIMARY KEY);`},
+		)).To(Succeed())
+		Expect(tables(db)).To(ContainElement("m2"))
+		Expect(applied(db)).To(Equal([]int{1, 2}))
+	})
+
+	It("rejects invalid and duplicate versions", func() {
+		Expect(apid.Data().RegisterMigrations("migrate_invalid",
+			apid.Migration{Version: 0, Up: `SELECT 1;`})).NotTo(Succeed())
+		Expect(apid.Data().RegisterMigrations("migrate_invalid",
+			apid.Migration{Version: 1, Up: `SELECT 1;`}, apid.Migration{Version: 1, Up: `SELECT 2;`})).NotTo(Succeed())
+		Expect(apid.Data().RegisterMigrations("migrate_invalid",
+			apid.Migration{Version: 1})).NotTo(Succeed())
+	})
+
+	It("rolls back a failed migration", func() {
+		Expect(apid.Data().RegisterMigrations("migrate_fail",
+			apid.Migration{Version: 1, Up: `CREATE TABLE m1 (id INTEGER PRIMARY KEY);`},
+			apid.Migration{Version: 2, Up: `CREATE TABLE m2 (id INTEGER PRIMARY KEY); INSERT INTO missing VALUES (1);`},
+		)).To(Succeed())
+
+		_, err := apid.Data().DBVersionForID("migrate_fail", "v1")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("migration 2"))
+
+		raw, err := sql.Open("sqlite3", data.DBPath(data.VersionedDBID("migrate_fail", "v1")))
+		Expect(err).NotTo(HaveOccurred())
+		defer raw.Close()
+		var count int
+		Expect(raw.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'm2'`).Scan(&count)).To(Succeed())
+		Expect(count).To(BeZero())
+		Expect(raw.QueryRow(`SELECT count(*) FROM _apid_migrations`).Scan(&count)).To(Succeed())
+		Expect(count).To(Equal(1))
+	})
+
+	It("migrates down to a target version", func() {
+		Expect(apid.Data().RegisterMigrations("migrate_down",
+			apid.Migration{Version: 1, Up: `CREATE TABLE m1 (id INTEGER PRIMARY KEY);`},
+			apid.Migration{Version: 2, Up: `CREATE TABLE m2 (id INTEGER PRIMARY KEY);`, Down: `DROP TABLE m2;`},
+		)).To(Succeed())
+		db, err := apid.Data().DBVersionForID("migrate_down", "v1")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(apid.Data().MigrateDB("migrate_down", "v1", 1)).To(Succeed())
+		Expect(tables(db)).NotTo(ContainElement("m2"))
+		Expect(applied(db)).To(Equal([]int{1}))
+
+		// no Down SQL
+		Expect(apid.Data().MigrateDB("migrate_down", "v1", 0)).NotTo(Succeed())
+		Expect(applied(db)).To(Equal([]int{1}))
+
+		Expect(apid.Data().MigrateDB("migrate_down", "v1", 2)).To(Succeed())
+		Expect(applied(db)).To(Equal([]int{1, 2}))
+	})
+
+	It("detects applied migrations that changed", func() {
+		Expect(apid.Data().RegisterMigrations("migrate_drift",
+			apid.Migration{Version: 1, Up: `CREATE TABLE m1 (id INTEGER PRIMARY KEY);`},
+		)).To(Succeed())
+		db, err := apid.Data().DBVersionForID("migrate_drift", "v1")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = db.Exec(`UPDATE _apid_migrations SET checksum = 'edited' WHERE version = 1`)
+		Expect(err).NotTo(HaveOccurred())
+		err = apid.Data().MigrateDB("migrate_drift", "v1", 1)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("changed since it was applied"))
+	})
+
+	It("applies a migration once when run concurrently", func() {
+		db, err := apid.Data().DBVersionForID("migrate_concurrent", "v1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(apid.Data().RegisterMigrations("migrate_concurrent",
+			apid.Migration{Version: 1, Up: `CREATE TABLE m1 (id INTEGER PRIMARY KEY);`},
+		)).To(Succeed())
+
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			go func() {
+				errs <- apid.Data().MigrateDB("migrate_concurrent", "v1", 1)
+			}()
+		}
+		for i := 0; i < 10; i++ {
+			Expect(<-errs).NotTo(HaveOccurred())
+		}
+		Expect(applied(db)).To(Equal([]int{1}))
+	})
+})
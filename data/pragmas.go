@@ -0,0 +1,160 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apid/apid-core/data/wrap"
+	"github.com/spf13/cast"
+)
+
+// The PRAGMAs are set on every connection of a DB, from the data_<pragma> keys overridden by the data_db_pragmas of
+// the DB ID. The connect hooks registered by plugins then run, eg. to register SQL functions or collations.
+
+// PRAGMAs set by the data_<pragma> keys, in order
+var pragmaKeys = []struct {
+	pragma string
+	key    string
+}{
+	{"journal_mode", configJournalModeKey},
+	{"foreign_keys", configForeignKeysKey},
+	{"busy_timeout", configBusyTimeoutKey},
+	{"synchronous", configSynchronousKey},
+	{"cache_size", configCacheSizeKey},
+	{"mmap_size", configMmapSizeKey},
+	{"temp_store", configTempStoreKey},
+}
+
+var (
+	pragmaName  = regexp.MustCompile(`^[a-z_]+$`)
+	pragmaValue = regexp.MustCompile(`^-?[A-Za-z0-9_]+$`)
+)
+
+// registered connect hooks by DB ID
+var hooks = make(map[string][]wrap.ConnectHook)
+var hooksSync sync.Mutex
+
+func (d *dataService) RegisterConnectHook(id string, hook func(conn driver.Conn) error) {
+	id, _ = defaultIDs(id, "")
+	hooksSync.Lock()
+	defer hooksSync.Unlock()
+	hooks[id] = append(hooks[id], hook)
+}
+
+// the hooks of the connections of the DBs of id, setting the PRAGMAs if sqlite
+func connectHooks(id string, sqlite bool) ([]wrap.ConnectHook, error) {
+	var all []wrap.ConnectHook
+	if sqlite {
+		pragmas, err := dbPragmas(id)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, func(conn driver.Conn) error {
+			for _, pragma := range pragmas {
+				if err := exec(conn, "PRAGMA "+pragma); err != nil {
+					return fmt.Errorf("PRAGMA %s: %v", pragma, err)
+				}
+			}
+			return nil
+		})
+	}
+	hooksSync.Lock()
+	defer hooksSync.Unlock()
+	return append(all, hooks[id]...), nil
+}
+
+// "name=value" PRAGMAs of the DBs of id
+func dbPragmas(id string) ([]string, error) {
+	values := make(map[string]string)
+	var names []string
+	set := func(name string, value interface{}) error {
+		name = strings.ToLower(name)
+		v := cast.ToString(value)
+		if b, ok := value.(bool); ok {
+			v = "OFF"
+			if b {
+				v = "ON"
+			}
+		}
+		if !pragmaName.MatchString(name) || !pragmaValue.MatchString(v) {
+			return fmt.Errorf("invalid PRAGMA %s = '%v'", name, value)
+		}
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = v
+		return nil
+	}
+
+	for _, p := range pragmaKeys {
+		value := config.Get(p.key)
+		if value == nil || value == "" {
+			continue
+		}
+		switch p.key {
+		case configForeignKeysKey:
+			value = config.GetBool(p.key)
+		case configBusyTimeoutKey:
+			value = int64(config.GetDuration(p.key) / time.Millisecond)
+		}
+		if err := set(p.pragma, value); err != nil {
+			return nil, err
+		}
+	}
+	var overrides map[string]interface{}
+	if dbPragmas, ok := config.GetStringMap(configDBPragmasKey)[id]; ok {
+		var err error
+		if overrides, err = cast.ToStringMapE(dbPragmas); err != nil {
+			return nil, fmt.Errorf("%s of %s: %v", configDBPragmasKey, id, err)
+		}
+	}
+	sorted := make([]string, 0, len(overrides))
+	for name := range overrides {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		if err := set(name, overrides[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	pragmas := make([]string, len(names))
+	for i, name := range names {
+		pragmas[i] = name + "=" + values[name]
+	}
+	return pragmas, nil
+}
+
+// makes the reader connections fail to write
+func queryOnly(conn driver.Conn) error {
+	return exec(conn, "PRAGMA query_only = ON")
+}
+
+func exec(conn driver.Conn, query string) error {
+	execer, ok := conn.(driver.Execer)
+	if !ok {
+		return fmt.Errorf("connection %T can't exec", conn)
+	}
+	_, err := execer.Exec(query, nil)
+	return err
+}
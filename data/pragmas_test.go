@@ -0,0 +1,105 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/apid/apid-core"
+	"github.com/mattn/go-sqlite3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PRAGMAs", func() {
+	const id = "test_pragmas"
+	var version string
+
+	BeforeEach(func() {
+		version = time.Now().String()
+	})
+
+	AfterEach(func() {
+		apid.Config().Set("data_db_pragmas", nil)
+		apid.Data().ReleaseDBForID(id, version)
+	})
+
+	pragma := func(tx apid.Tx, name string) string {
+		var value string
+		Expect(tx.QueryRow("PRAGMA " + name).Scan(&value)).To(Succeed())
+		return value
+	}
+
+	It("sets the PRAGMAs on every connection", func() {
+		apid.Config().Set("data_db_pragmas", map[string]interface{}{
+			id: map[string]interface{}{"synchronous": "OFF", "cache_size": -4000},
+		})
+		db, err := apid.Data().DBVersionForID(id, version)
+		Expect(err).NotTo(HaveOccurred())
+
+		tx, err := db.Begin()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(strings.ToLower(pragma(tx, "journal_mode"))).To(Equal("wal"))
+		Expect(pragma(tx, "foreign_keys")).To(Equal("1"))
+		Expect(pragma(tx, "busy_timeout")).To(Equal("5000"))
+		Expect(pragma(tx, "synchronous")).To(Equal("0"))
+		Expect(pragma(tx, "cache_size")).To(Equal("-4000"))
+		Expect(pragma(tx, "query_only")).To(Equal("0"))
+
+		// concurrent read-only transactions run on connections of their own
+		var readers []apid.Tx
+		for i := 0; i < 3; i++ {
+			ro, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pragma(ro, "foreign_keys")).To(Equal("1"))
+			Expect(pragma(ro, "cache_size")).To(Equal("-4000"))
+			Expect(pragma(ro, "query_only")).To(Equal("1"))
+			readers = append(readers, ro)
+		}
+		for _, ro := range readers {
+			Expect(ro.Rollback()).To(Succeed())
+		}
+		Expect(tx.Rollback()).To(Succeed())
+	})
+
+	It("fails to open a DB with an invalid PRAGMA", func() {
+		apid.Config().Set("data_db_pragmas", map[string]interface{}{
+			id: map[string]interface{}{"cache_size": "1; DROP TABLE t"},
+		})
+		_, err := apid.Data().DBVersionForID(id, version)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("calls the connect hooks of the DB ID", func() {
+		apid.Data().RegisterConnectHook(id, func(conn driver.Conn) error {
+			return conn.(*sqlite3.SQLiteConn).RegisterFunc("twice", func(i int64) int64 {
+				return 2 * i
+			}, true)
+		})
+		db, err := apid.Data().DBVersionForID(id, version)
+		Expect(err).NotTo(HaveOccurred())
+		var n int64
+		Expect(db.QueryRow(`SELECT twice(21)`).Scan(&n)).To(Succeed())
+		Expect(n).To(Equal(int64(42)))
+
+		other, err := apid.Data().DBVersionForID("test_no_hooks", version)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(other.QueryRow(`SELECT twice(21)`).Scan(&n)).NotTo(Succeed())
+	})
+})
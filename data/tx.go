@@ -0,0 +1,92 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/apid/apid-core"
+	"github.com/mattn/go-sqlite3"
+)
+
+// retries of WithTx transactions by DB ID
+var txRetries = expvar.NewMap("data_tx_retries")
+
+// WithTx transactions that failed after the last attempt by DB ID
+var txRetriesExhausted = expvar.NewMap("data_tx_retries_exhausted")
+
+// retries while the DB is busy if the driver's busy errors are known, ie. SQLite
+func (d *ApidDb) WithTx(ctx context.Context, fn func(apid.Tx) error) error {
+	attempts := config.GetInt(configTxMaxAttemptsKey)
+	backoff := config.GetDuration(configTxBackoffKey)
+	maxBackoff := config.GetDuration(configTxMaxBackoffKey)
+	// versions of an ID share the counters
+	id := path.Dir(d.id)
+
+	for attempt := 1; ; attempt++ {
+		err := d.runTx(ctx, fn)
+		if err == nil || d.dialect.busy == nil || !d.dialect.busy(err) {
+			return err
+		}
+		if attempt >= attempts {
+			txRetriesExhausted.Add(id, 1)
+			return fmt.Errorf("transaction failed after %d attempts: %v", attempt, err)
+		}
+
+		txRetries.Add(id, 1)
+		log.Warnf("Retrying transaction of DB %s in %v, attempt %d failed: %v", d.id, backoff, attempt, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// runs fn in a transaction, rolled back unless committed
+func (d *ApidDb) runTx(ctx context.Context, fn func(apid.Tx) error) (err error) {
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	if err = fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	return tx.Commit()
+}
+
+// whether the error is SQLITE_BUSY or SQLITE_LOCKED
+func sqliteBusy(err error) bool {
+	var e sqlite3.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked
+}
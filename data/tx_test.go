@@ -0,0 +1,147 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_test
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/apid/apid-core"
+	"github.com/mattn/go-sqlite3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("WithTx", func() {
+	var db apid.DB
+	var version string
+	var before map[string]int64
+
+	counter := func(key string) int64 {
+		v := expvar.Get(key).(*expvar.Map).Get("test_with_tx")
+		if v == nil {
+			return 0
+		}
+		return v.(*expvar.Int).Value()
+	}
+
+	BeforeEach(func() {
+		var err error
+		version = time.Now().String()
+		db, err = apid.Data().DBVersionForID("test_with_tx", version)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = db.Exec(`CREATE TABLE items (name TEXT)`)
+		Expect(err).NotTo(HaveOccurred())
+		apid.Config().Set("data_tx_retry_backoff", "1ms")
+		before = map[string]int64{
+			"data_tx_retries":           counter("data_tx_retries"),
+			"data_tx_retries_exhausted": counter("data_tx_retries_exhausted"),
+		}
+	})
+
+	AfterEach(func() {
+		apid.Data().ReleaseDBForID("test_with_tx", version)
+	})
+
+	items := func() int {
+		var n int
+		Expect(db.QueryRow(`SELECT count(*) FROM items`).Scan(&n)).To(Succeed())
+		return n
+	}
+
+	insert := func(tx apid.Tx) error {
+		_, err := tx.Exec(`INSERT INTO items (name) VALUES ('item')`)
+		return err
+	}
+
+	// counted by ID, since the spec began
+	retries := func(key string) int64 {
+		return counter(key) - before[key]
+	}
+
+	It("commits when fn succeeds", func() {
+		Expect(db.WithTx(context.Background(), insert)).To(Succeed())
+		Expect(items()).To(Equal(1))
+	})
+
+	It("rolls back when fn fails", func() {
+		failed := errors.New("failed")
+		err := db.WithTx(context.Background(), func(tx apid.Tx) error {
+			Expect(insert(tx)).To(Succeed())
+			return failed
+		})
+		Expect(err).To(Equal(failed))
+		Expect(items()).To(BeZero())
+	})
+
+	It("rolls back and releases the DB when fn panics", func() {
+		Expect(func() {
+			db.WithTx(context.Background(), func(tx apid.Tx) error {
+				Expect(insert(tx)).To(Succeed())
+				panic("fn")
+			})
+		}).To(Panic())
+		Expect(items()).To(BeZero())
+
+		tx, err := db.Begin()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tx.Rollback()).To(Succeed())
+	})
+
+	It("retries while the DB is busy or locked", func() {
+		attempts := 0
+		err := db.WithTx(context.Background(), func(tx apid.Tx) error {
+			attempts++
+			Expect(insert(tx)).To(Succeed())
+			switch attempts {
+			case 1:
+				return sqlite3.Error{Code: sqlite3.ErrBusy}
+			case 2:
+				return sqlite3.Error{Code: sqlite3.ErrLocked}
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attempts).To(Equal(3))
+		Expect(items()).To(Equal(1))
+		Expect(retries("data_tx_retries")).To(Equal(int64(2)))
+	})
+
+	It("gives up after the max attempts", func() {
+		apid.Config().Set("data_tx_max_attempts", 2)
+		defer apid.Config().Set("data_tx_max_attempts", 5)
+		attempts := 0
+		err := db.WithTx(context.Background(), func(tx apid.Tx) error {
+			attempts++
+			return sqlite3.Error{Code: sqlite3.ErrBusy}
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(attempts).To(Equal(2))
+		Expect(retries("data_tx_retries")).To(Equal(int64(1)))
+		Expect(retries("data_tx_retries_exhausted")).To(Equal(int64(1)))
+	})
+
+	It("stops retrying when the context is done", func() {
+		apid.Config().Set("data_tx_retry_backoff", "1h")
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := db.WithTx(ctx, func(tx apid.Tx) error {
+			return sqlite3.Error{Code: sqlite3.ErrBusy}
+		})
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+})
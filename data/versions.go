@@ -0,0 +1,212 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apid/apid-core"
+)
+
+// The DBs are laid out as <local_storage_path>/<data_path>/<id>/<version>/sqlite3, the current version of an ID
+// is recorded in <id>/.current. The GC deletes the versions that aren't open, current or base, except the most
+// recently modified ones of each ID.
+
+const currentVersionFile = ".current"
+
+func dataDir() string {
+	return path.Join(config.GetString("local_storage_path"), config.GetString(configDataPathKey))
+}
+
+func (d *dataService) ListDBIDs() ([]string, error) {
+	infos, err := ioutil.ReadDir(dataDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, info := range infos {
+		if info.IsDir() {
+			ids = append(ids, info.Name())
+		}
+	}
+	return ids, nil
+}
+
+// versions of the DB, most recently modified first
+func (d *dataService) ListDBVersions(id string) ([]apid.DBVersionInfo, error) {
+	id, _ = defaultIDs(id, "")
+	if err := validIDs(id); err != nil {
+		return nil, err
+	}
+	idDir := path.Join(dataDir(), id)
+	infos, err := ioutil.ReadDir(idDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := currentVersion(id)
+
+	dbMapSync.RLock()
+	defer dbMapSync.RUnlock()
+	var versions []apid.DBVersionInfo
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		v := apid.DBVersionInfo{
+			ID:      id,
+			Version: info.Name(),
+			Open:    isOpen(VersionedDBID(id, info.Name())),
+			Current: info.Name() == current,
+		}
+		// the DB file, its WAL...
+		files, _ := ioutil.ReadDir(path.Join(idDir, info.Name()))
+		for _, f := range files {
+			v.Size += f.Size()
+			if f.ModTime().After(v.ModTime) {
+				v.ModTime = f.ModTime()
+			}
+		}
+		versions = append(versions, v)
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].ModTime.After(versions[j].ModTime)
+	})
+	return versions, nil
+}
+
+// open or being created, must hold dbMapSync
+func isOpen(versionedID string) bool {
+	return dbMap[versionedID] != nil || creating[versionedID]
+}
+
+func (d *dataService) SetCurrentDBVersion(id, version string) error {
+	id, version = defaultIDs(id, version)
+	if err := validIDs(id, version); err != nil {
+		return err
+	}
+	idDir := path.Join(dataDir(), id)
+	if err := os.MkdirAll(idDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(idDir, currentVersionFile), []byte(version), 0600)
+}
+
+// "" if not set
+func currentVersion(id string) string {
+	b, err := ioutil.ReadFile(path.Join(dataDir(), id, currentVersionFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func (d *dataService) GCDBVersions(keep int) ([]apid.DBVersionInfo, error) {
+	ids, err := d.ListDBIDs()
+	if err != nil {
+		return nil, err
+	}
+	var deleted []apid.DBVersionInfo
+	for _, id := range ids {
+		versions, err := d.ListDBVersions(id)
+		if err != nil {
+			return deleted, err
+		}
+		kept := 0
+		for _, v := range versions {
+			if v.Open || v.Current || v.Version == commonDBVersion {
+				continue
+			}
+			if kept < keep {
+				kept++
+				continue
+			}
+			if deleteVersion(v) {
+				deleted = append(deleted, v)
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// deletes the files of the version unless it was opened meanwhile
+func deleteVersion(v apid.DBVersionInfo) bool {
+	versionedID := VersionedDBID(v.ID, v.Version)
+	dbMapSync.Lock()
+	defer dbMapSync.Unlock()
+	if isOpen(versionedID) {
+		return false
+	}
+	if err := os.RemoveAll(path.Dir(DBPath(versionedID))); err != nil {
+		log.Errorf("error removing DB files of %s: %v", versionedID, err)
+		return false
+	}
+	log.Infof("Deleted stale DB %s, last modified %v", versionedID, v.ModTime)
+	return true
+}
+
+// runs the GC once the plugins are initialized, so that they've opened their DBs, then every data_gc_interval
+// until shutdown, if data_gc_keep_versions is set
+func (d *dataService) startGC() {
+	keep := config.GetInt(configGCKeepKey)
+	if keep <= 0 {
+		return
+	}
+	gc := func() {
+		if _, err := d.GCDBVersions(keep); err != nil {
+			log.Errorf("error deleting stale DB versions: %v", err)
+		}
+	}
+	stop := make(chan struct{})
+	var started, stopped sync.Once
+	apid.Events().ListenFunc(apid.ShutdownEventSelector, func(apid.Event) {
+		stopped.Do(func() { close(stop) })
+	})
+	apid.Events().ListenFunc(apid.SystemEventsSelector, func(e apid.Event) {
+		if _, ok := e.(apid.PluginsInitializedEvent); !ok {
+			return
+		}
+		started.Do(func() {
+			gc()
+			interval := config.GetDuration(configGCIntervalKey)
+			if interval <= 0 {
+				return
+			}
+			go func() {
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						gc()
+					case <-stop:
+						return
+					}
+				}
+			}()
+		})
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/data"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DB versions", func() {
+	const id = "test_versions"
+	var storageDir string
+
+	// a version left on disk, modified hours ago
+	stale := func(version string, hours int) {
+		dbPath := data.DBPath(data.VersionedDBID(id, version))
+		Expect(os.MkdirAll(path.Dir(dbPath), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(dbPath, []byte("db"), 0600)).To(Succeed())
+		modTime := time.Now().Add(-time.Duration(hours) * time.Hour)
+		Expect(os.Chtimes(dbPath, modTime, modTime)).To(Succeed())
+	}
+
+	versionNames := func(versions []apid.DBVersionInfo) []string {
+		var names []string
+		for _, v := range versions {
+			names = append(names, v.Version)
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		var err error
+		storageDir, err = ioutil.TempDir(tmpDir, "versions")
+		Expect(err).NotTo(HaveOccurred())
+		apid.Config().Set("local_storage_path", storageDir)
+
+		stale("base", 5)
+		stale("live", 4)
+		stale("old1", 3)
+		stale("old2", 2)
+		stale("old3", 1)
+		Expect(apid.Data().SetCurrentDBVersion(id, "live")).To(Succeed())
+		_, err = apid.Data().DBVersionForID(id, "open")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		apid.Data().ReleaseDBForID(id, "open")
+		apid.Config().Set("local_storage_path", tmpDir)
+	})
+
+	It("lists the IDs and versions on disk", func() {
+		ids, err := apid.Data().ListDBIDs()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ids).To(Equal([]string{id}))
+
+		versions, err := apid.Data().ListDBVersions(id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(versionNames(versions)).To(Equal([]string{"open", "old3", "old2", "old1", "live", "base"}))
+		for _, v := range versions {
+			Expect(v.ID).To(Equal(id))
+			Expect(v.Size).To(BeNumerically(">", 0))
+			Expect(v.Open).To(Equal(v.Version == "open"))
+			Expect(v.Current).To(Equal(v.Version == "live"))
+		}
+		Expect(versions[2].ModTime).To(BeTemporally("~", time.Now().Add(-2*time.Hour), time.Minute))
+
+		versions, err = apid.Data().ListDBVersions("none")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(versions).To(BeEmpty())
+	})
+
+	It("deletes the stale versions", func() {
+		deleted, err := apid.Data().GCDBVersions(2)
+		Expect(err).NotTo(HaveOccurred())
+		// the open, current and base versions aren't counted
+		Expect(versionNames(deleted)).To(Equal([]string{"old1"}))
+		Expect(data.DBPath(data.VersionedDBID(id, "old1"))).NotTo(BeAnExistingFile())
+
+		versions, err := apid.Data().ListDBVersions(id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(versionNames(versions)).To(Equal([]string{"open", "old3", "old2", "live", "base"}))
+
+		deleted, err = apid.Data().GCDBVersions(0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(versionNames(deleted)).To(Equal([]string{"old3", "old2"}))
+	})
+
+	It("rejects IDs and versions outside of the data path", func() {
+		_, err := apid.Data().ListDBVersions("../" + id)
+		Expect(err).To(HaveOccurred())
+		Expect(apid.Data().SetCurrentDBVersion(id, "../live")).NotTo(Succeed())
+		Expect(apid.Data().SetCurrentDBVersion("..", "live")).NotTo(Succeed())
+	})
+
+	It("runs the GC once the plugins are initialized, until shutdown", func() {
+		apid.Config().Set("data_gc_keep_versions", 1)
+		apid.Config().Set("data_gc_interval", 50*time.Millisecond)
+		defer apid.Config().Set("data_gc_keep_versions", 0)
+		defer apid.Config().Set("data_gc_interval", 0)
+		data.CreateDataService()
+		defer func() {
+			<-apid.Events().Emit(apid.ShutdownEventSelector, apid.ShutdownEvent{Description: "test"})
+		}()
+
+		// a plugin may open it while initialized
+		old1 := data.DBPath(data.VersionedDBID(id, "old1"))
+		Consistently(func() string { return old1 }, 200*time.Millisecond).Should(BeAnExistingFile())
+
+		<-apid.Events().Emit(apid.SystemEventsSelector, apid.PluginsInitializedEvent{Description: "test"})
+		Expect(old1).NotTo(BeAnExistingFile())
+		Expect(data.DBPath(data.VersionedDBID(id, "old3"))).To(BeAnExistingFile())
+
+		// periodically
+		stale("old4", 0)
+		Eventually(func() string { return data.DBPath(data.VersionedDBID(id, "old3")) }).ShouldNot(BeAnExistingFile())
+	})
+})
@@ -15,61 +15,86 @@
 package wrap
 
 import (
+	"context"
 	"database/sql/driver"
+	"errors"
 
 	"sync/atomic"
 
 	"github.com/apid/apid-core"
-	"github.com/mattn/go-sqlite3"
 )
 
 type wrapConn struct {
-	*sqlite3.SQLiteConn
+	driver.Conn
 	log         apid.LogService
 	stmtCounter int64
 	txCounter   int64
+	// made read-only by a connect hook
+	readOnly bool
 }
 
-func (c *wrapConn) Swap(cc *sqlite3.SQLiteConn) {
-	c.SQLiteConn = cc
-}
+// as database/sql would fail
+var errReadOnly = errors.New("sql: driver does not support read-only transactions")
 
 func (c *wrapConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *wrapConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
 	stmtID := atomic.AddInt64(&c.stmtCounter, 1)
-	log := c.log.WithField("stmt", stmtID)
+	log := apid.LogWithContext(ctx, c.log).WithField("stmt", stmtID)
 	log.Debugf("begin prepare stmt: %s", query)
 
-	stmt, err := c.SQLiteConn.Prepare(query)
+	var stmt driver.Stmt
+	var err error
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else if err = ctx.Err(); err == nil {
+		stmt, err = c.Conn.Prepare(query)
+	}
 	if err != nil {
 		log.Errorf("prepare stmt failed: %s", err)
 		return nil, err
 	}
 
 	log.Debug("end prepare stmt")
-	s := stmt.(*sqlite3.SQLiteStmt)
-	return &wrapStmt{s, log}, nil
+	return &wrapStmt{stmt, log}, nil
 }
 
 func (c *wrapConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// without driver.ConnBeginTx, read-only transactions require a read-only connection, eg. SQLite query_only
+func (c *wrapConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
 	txID := atomic.AddInt64(&c.txCounter, 1)
-	log := c.log.WithField("tx", txID)
+	log := apid.LogWithContext(ctx, c.log).WithField("tx", txID)
 	log.Debug("begin trans")
 
-	tx, err := c.SQLiteConn.Begin()
+	var tx driver.Tx
+	var err error
+	if bt, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = bt.BeginTx(ctx, opts)
+	} else if opts.Isolation != driver.IsolationLevel(0) {
+		err = errors.New("isolation levels not supported")
+	} else if opts.ReadOnly && !c.readOnly {
+		err = errReadOnly
+	} else if err = ctx.Err(); err == nil {
+		tx, err = c.Conn.Begin()
+	}
 	if err != nil {
 		log.Errorf("begin trans failed: %s", err)
 		return nil, err
 	}
 
 	log.Debug("end begin trans")
-	t := tx.(*sqlite3.SQLiteTx)
-	return &wrapTx{t, log}, nil
+	return &wrapTx{tx, log}, nil
 }
 
 func (c *wrapConn) Close() (err error) {
 	c.log.Debug("begin close conn")
 
-	if err = c.SQLiteConn.Close(); err != nil {
+	if err = c.Conn.Close(); err != nil {
 		c.log.Errorf("close conn failed: %s", err)
 		return
 	}
@@ -79,8 +104,13 @@ func (c *wrapConn) Close() (err error) {
 }
 
 func (c *wrapConn) Query(query string, args []driver.Value) (rows driver.Rows, err error) {
+	q, ok := c.Conn.(driver.Queryer)
+	if !ok {
+		// database/sql prepares a statement
+		return nil, driver.ErrSkip
+	}
 	c.log.Debugf("begin query: %s args: %#v", query, args)
-	rows, err = c.SQLiteConn.Query(query, args)
+	rows, err = q.Query(query, args)
 	if err != nil {
 		c.log.Debugf("query failed: %s", err)
 		return
@@ -89,3 +119,105 @@ func (c *wrapConn) Query(query string, args []driver.Value) (rows driver.Rows, e
 	c.log.Debugf("end query: %#v", rows)
 	return
 }
+
+func (c *wrapConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (rows driver.Rows, err error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		if _, ok := c.Conn.(driver.Queryer); !ok {
+			return nil, driver.ErrSkip
+		}
+	}
+	log := apid.LogWithContext(ctx, c.log)
+	log.Debugf("begin query: %s args: %#v", query, args)
+	if qc != nil {
+		rows, err = qc.QueryContext(ctx, query, args)
+	} else {
+		var dargs []driver.Value
+		if dargs, err = values(args); err == nil {
+			if err = ctx.Err(); err == nil {
+				rows, err = c.Conn.(driver.Queryer).Query(query, dargs)
+			}
+		}
+	}
+	if err != nil {
+		log.Debugf("query failed: %s", err)
+		return
+	}
+
+	log.Debugf("end query: %#v", rows)
+	return
+}
+
+func (c *wrapConn) Exec(query string, args []driver.Value) (result driver.Result, err error) {
+	e, ok := c.Conn.(driver.Execer)
+	if !ok {
+		// database/sql prepares a statement
+		return nil, driver.ErrSkip
+	}
+	c.log.Debugf("begin exec: %s args: %#v", query, args)
+	result, err = e.Exec(query, args)
+	if err != nil {
+		c.log.Errorf("exec failed: %s", err)
+		return
+	}
+
+	c.log.Debugf("end exec: %#v", result)
+	return
+}
+
+func (c *wrapConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (result driver.Result, err error) {
+	ec, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		if _, ok := c.Conn.(driver.Execer); !ok {
+			return nil, driver.ErrSkip
+		}
+	}
+	log := apid.LogWithContext(ctx, c.log)
+	log.Debugf("begin exec: %s args: %#v", query, args)
+	if ec != nil {
+		result, err = ec.ExecContext(ctx, query, args)
+	} else {
+		var dargs []driver.Value
+		if dargs, err = values(args); err == nil {
+			if err = ctx.Err(); err == nil {
+				result, err = c.Conn.(driver.Execer).Exec(query, dargs)
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("exec failed: %s", err)
+		return
+	}
+
+	log.Debugf("end exec: %#v", result)
+	return
+}
+
+func (c *wrapConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *wrapConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *wrapConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *wrapConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	// database/sql converts the value
+	return driver.ErrSkip
+}
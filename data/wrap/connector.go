@@ -0,0 +1,73 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wrap
+
+import (
+	"context"
+	"database/sql/driver"
+
+	"github.com/apid/apid-core"
+)
+
+// ConnectHook is called with each new connection, eg. to set PRAGMAs or register SQL functions.
+// conn is the connection of the wrapped driver, eg. a *sqlite3.SQLiteConn.
+type ConnectHook func(conn driver.Conn) error
+
+// NewConnector opens connections to dsn for sql.OpenDB, calling the hooks in order on each one
+func NewConnector(d driver.Driver, dsn string, log apid.LogService, hooks ...ConnectHook) driver.Connector {
+	return &connector{wrapDriver{d, log, new(int64)}, dsn, hooks, false}
+}
+
+// NewReadOnlyConnector is NewConnector for connections the hooks make read-only, eg. with SQLite query_only: read-only
+// transactions are begun as regular ones if the driver doesn't implement driver.ConnBeginTx
+func NewReadOnlyConnector(d driver.Driver, dsn string, log apid.LogService, hooks ...ConnectHook) driver.Connector {
+	return &connector{wrapDriver{d, log, new(int64)}, dsn, hooks, true}
+}
+
+type connector struct {
+	driver   wrapDriver
+	dsn      string
+	hooks    []ConnectHook
+	readOnly bool
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.open(func() (driver.Conn, error) {
+		if dc, ok := c.driver.Driver.(driver.DriverContext); ok {
+			connector, err := dc.OpenConnector(c.dsn)
+			if err != nil {
+				return nil, err
+			}
+			return connector.Connect(ctx)
+		}
+		return c.driver.Driver.Open(c.dsn)
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn.(*wrapConn).readOnly = c.readOnly
+	for _, hook := range c.hooks {
+		if err := hook(conn.(*wrapConn).Conn); err != nil {
+			c.driver.log.Errorf("connect hook failed: %v", err)
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
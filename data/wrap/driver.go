@@ -16,36 +16,56 @@ package wrap
 
 import (
 	"database/sql/driver"
+	"errors"
 	"strings"
 
 	"sync/atomic"
 
 	"github.com/apid/apid-core"
-	"github.com/mattn/go-sqlite3"
 )
 
+// The wrappers log the calls to any database/sql driver. They implement the optional driver interfaces (Context,
+// NamedValue...) by delegating to the wrapped driver if it implements them, or falling back like database/sql does.
+
 func NewDriver(d driver.Driver, log apid.LogService) driver.Driver {
-	return wrapDriver{d, log, 0}
+	return wrapDriver{d, log, new(int64)}
 }
 
 type wrapDriver struct {
 	driver.Driver
 	log     apid.LogService
-	counter int64
+	counter *int64
 }
 
 func (d wrapDriver) Open(dsn string) (driver.Conn, error) {
-	connId := atomic.AddInt64(&d.counter, 1)
+	internalDSN := strings.TrimPrefix(dsn, "dd:")
+	return d.open(func() (driver.Conn, error) {
+		return d.Driver.Open(internalDSN)
+	})
+}
+
+func (d wrapDriver) open(open func() (driver.Conn, error)) (driver.Conn, error) {
+	connId := atomic.AddInt64(d.counter, 1)
 	log := d.log.WithField("conn", connId)
 	log.Debug("begin open conn")
 
-	internalDSN := strings.TrimPrefix(dsn, "dd:")
-	internalCon, err := d.Driver.Open(internalDSN)
+	internalCon, err := open()
 	if err != nil {
 		log.Errorf("open conn failed: %v", err)
 		return nil, err
 	}
 
-	c := internalCon.(*sqlite3.SQLiteConn)
-	return &wrapConn{c, log, 0, 0}, nil
+	return &wrapConn{Conn: internalCon, log: log}, nil
+}
+
+// args of drivers without the NamedValue interfaces
+func values(named []driver.NamedValue) ([]driver.Value, error) {
+	args := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, errors.New("named arguments not supported by the driver")
+		}
+		args[i] = nv.Value
+	}
+	return args, nil
 }
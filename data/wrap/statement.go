@@ -15,20 +15,21 @@
 package wrap
 
 import (
+	"context"
 	"database/sql/driver"
+
 	"github.com/apid/apid-core"
-	"github.com/mattn/go-sqlite3"
 )
 
 type wrapStmt struct {
-	*sqlite3.SQLiteStmt
+	driver.Stmt
 	log apid.LogService
 }
 
 func (s *wrapStmt) Close() (err error) {
 	s.log.Debug("begin close stmt")
 
-	if err = s.SQLiteStmt.Close(); err != nil {
+	if err = s.Stmt.Close(); err != nil {
 		s.log.Debugf("close stmt failed: %s", err)
 		return
 	}
@@ -37,14 +38,10 @@ func (s *wrapStmt) Close() (err error) {
 	return
 }
 
-func (s *wrapStmt) NumInput() int {
-	return s.SQLiteStmt.NumInput()
-}
-
 func (s *wrapStmt) Exec(args []driver.Value) (result driver.Result, err error) {
 	s.log.Debugf("begin exec: %#v", args)
 
-	result, err = s.SQLiteStmt.Exec(args)
+	result, err = s.Stmt.Exec(args)
 	if err != nil {
 		s.log.Errorf("failed exec: %s", err)
 		return
@@ -57,7 +54,7 @@ func (s *wrapStmt) Exec(args []driver.Value) (result driver.Result, err error) {
 func (s *wrapStmt) Query(args []driver.Value) (rows driver.Rows, err error) {
 	s.log.Debugf("begin query: %#v", args)
 
-	rows, err = s.SQLiteStmt.Query(args)
+	rows, err = s.Stmt.Query(args)
 	if err != nil {
 		s.log.Errorf("failed query: %s", err)
 		return
@@ -66,3 +63,57 @@ func (s *wrapStmt) Query(args []driver.Value) (rows driver.Rows, err error) {
 	s.log.Debugf("end query: %#v", rows)
 	return
 }
+
+func (s *wrapStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (result driver.Result, err error) {
+	log := apid.LogWithContext(ctx, s.log)
+	log.Debugf("begin exec: %#v", args)
+
+	if ec, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = ec.ExecContext(ctx, args)
+	} else {
+		var dargs []driver.Value
+		if dargs, err = values(args); err == nil {
+			if err = ctx.Err(); err == nil {
+				result, err = s.Stmt.Exec(dargs)
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("failed exec: %s", err)
+		return
+	}
+
+	log.Debugf("end exec: %#v", result)
+	return
+}
+
+func (s *wrapStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (rows driver.Rows, err error) {
+	log := apid.LogWithContext(ctx, s.log)
+	log.Debugf("begin query: %#v", args)
+
+	if qc, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = qc.QueryContext(ctx, args)
+	} else {
+		var dargs []driver.Value
+		if dargs, err = values(args); err == nil {
+			if err = ctx.Err(); err == nil {
+				rows, err = s.Stmt.Query(dargs)
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("failed query: %s", err)
+		return
+	}
+
+	log.Debugf("end query: %#v", rows)
+	return
+}
+
+func (s *wrapStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	// database/sql converts the value
+	return driver.ErrSkip
+}
@@ -15,19 +15,20 @@
 package wrap
 
 import (
+	"database/sql/driver"
+
 	"github.com/apid/apid-core"
-	"github.com/mattn/go-sqlite3"
 )
 
 type wrapTx struct {
-	*sqlite3.SQLiteTx
+	driver.Tx
 	log apid.LogService
 }
 
 func (tx *wrapTx) Commit() (err error) {
 	tx.log.Debug("begin commit")
 
-	if err = tx.SQLiteTx.Commit(); err != nil {
+	if err = tx.Tx.Commit(); err != nil {
 		tx.log.Errorf("failed commit: %s", err)
 		return
 	}
@@ -39,7 +40,7 @@ func (tx *wrapTx) Commit() (err error) {
 func (tx *wrapTx) Rollback() (err error) {
 	tx.log.Debug("begin rollback")
 
-	if err = tx.SQLiteTx.Rollback(); err != nil {
+	if err = tx.Tx.Rollback(); err != nil {
 		tx.log.Errorf("failed rollback: %s", err)
 	}
 
@@ -17,6 +17,7 @@ package apid
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"time"
 )
 
@@ -27,24 +28,99 @@ type DataService interface {
 	DBVersion(version string) (db DB, err error)
 	DBVersionForID(id, version string) (db DB, err error)
 
-	// will set DB to close and delete when no more references
+	// closes and deletes the DB when its last handle is released, or now if it has none. A DB returned by DB(),
+	// DBVersion()... isn't counted as a handle: it's unusable once closed, use AcquireDB to keep it open.
 	ReleaseDB(version string)
 	ReleaseCommonDB()
 	ReleaseDBForID(id, version string)
+	// opens the DB if needed and counts a handle to it, "" for the common ID or the base version.
+	// every handle must be released.
+	AcquireDB(id, version string) (DBHandle, error)
+
+	// copies the DB to file while it's in use, "" for the common ID or the base version
+	BackupDB(id, version, file string) error
+	// creates the DB of a new version from a backup file
+	RestoreDB(id, version, file string) error
+	// opens a new version of a DB, a copy of fromVersion. "" for the common ID or the base version.
+	CloneDBVersion(id, fromVersion, toVersion string) (DB, error)
+
+	// IDs of the DBs on disk
+	ListDBIDs() ([]string, error)
+	// versions of the DB on disk, most recently modified first. "" for the common ID.
+	ListDBVersions(id string) ([]DBVersionInfo, error)
+	// marks the version kept by the GC
+	SetCurrentDBVersion(id, version string) error
+	// deletes the versions that aren't open, current or base, except the keep most recently modified of each ID
+	GCDBVersions(keep int) (deleted []DBVersionInfo, err error)
+
+	// hook called with each new connection of the DBs of id, eg. to register SQL functions or collations.
+	// conn is the connection of the driver, eg. a *sqlite3.SQLiteConn. register before opening the DBs.
+	RegisterConnectHook(id string, hook func(conn driver.Conn) error)
+
+	// registers schema migrations of the DBs of id, "" for the DBs of DB() and DBVersion().
+	// pending migrations are applied in Version order when a DB is opened, and to the DBs of id already open.
+	RegisterMigrations(id string, migrations ...Migration) error
+	// migrates the DB up or down to the target Version, 0 reverting every migration
+	MigrateDB(id, version string, target int) error
+}
+
+// a schema migration, see DataService.RegisterMigrations
+type Migration struct {
+	// orders the migrations of a DB, > 0 and unique
+	Version     int
+	Description string
+	// SQL applying the migration, may hold several statements
+	Up string
+	// SQL reverting Up, optional
+	Down string
+}
+
+// a version of a DB on disk, see DataService.ListDBVersions
+type DBVersionInfo struct {
+	ID      string
+	Version string
+	// bytes of the DB files
+	Size    int64
+	ModTime time.Time
+	Open    bool
+	Current bool
+}
+
+// a DB reference, see DataService.AcquireDB
+type DBHandle interface {
+	DB
+	// releases the handle, once
+	Release()
 }
 
 type DB interface {
 	Ping() error
+	// the statement runs on the single writer connection, like a transaction: don't use it while one is open
 	Prepare(query string) (*sql.Stmt, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	// writes wait for the open transaction, failing after data_write_wait_timeout: use Tx.Exec in a transaction
 	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
 	QueryRow(query string, args ...interface{}) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	// transactions of a DB are serialized, Begin waits for the current one to end
 	Begin() (Tx, error)
+	// like Begin, giving up waiting when ctx is done. the transaction is rolled back when ctx is done.
+	// read-only transactions don't wait.
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error)
+	// runs fn in a transaction, committed if fn returns nil and rolled back if it fails or panics.
+	// the transaction is retried while the DB is busy or locked, with SQLite only.
+	WithTx(ctx context.Context, fn func(Tx) error) error
+	// of the writer and reader connections together
 	Stats() sql.DBStats
 	SetConnMaxLifetime(d time.Duration)
+	// the pool settings apply to the reader connections only, writes use a single connection
 	SetMaxIdleConns(n int)
 	SetMaxOpenConns(n int)
 	QueryStructs(dest interface{}, query string, args ...interface{}) error
+	QueryStructsContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
 	//Close() error
 	//Stats() sql.DBStats
 	//Driver() driver.Driver
@@ -64,4 +140,5 @@ type Tx interface {
 	Stmt(stmt *sql.Stmt) *sql.Stmt
 	StmtContext(ctx context.Context, stmt *sql.Stmt) *sql.Stmt
 	QueryStructs(dest interface{}, query string, args ...interface{}) error
+	QueryStructsContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
 }
@@ -15,6 +15,7 @@
 package events
 
 import (
+	"context"
 	"reflect"
 	"sync"
 
@@ -39,6 +40,18 @@ func (em *eventManager) Emit(selector apid.EventSelector, event apid.Event) chan
 	return responseChannel
 }
 
+func (em *eventManager) EmitContext(ctx context.Context, selector apid.EventSelector, event apid.Event) chan apid.Event {
+	log := apid.LogWithContext(ctx, log)
+	log.Debugf("emit selector: '%s' event %v: %v", selector, &event, event)
+
+	responseChannel := make(chan apid.Event, 1)
+	em.EmitWithCallback(selector, event, func(e apid.Event) {
+		log.Debugf("event %v delivered to selector: '%s'", &event, selector)
+		responseChannel <- e
+	})
+	return responseChannel
+}
+
 func (em *eventManager) EmitWithCallback(selector apid.EventSelector, event apid.Event, callback apid.EventHandlerFunc) {
 	log.Debugf("emit with callback selector: '%s' event %v: %v", selector, &event, event)
 
@@ -170,7 +183,10 @@ func (d *dispatcher) Remove(h apid.EventHandler) {
 	for i := len(d.handlers) - 1; i >= 0; i-- {
 		ih := d.handlers[i]
 		if h == ih {
-			d.handlers = append(d.handlers[:i], d.handlers[i+1:]...)
+			// copied, delivery may be reading the current slice
+			cp := make([]apid.EventHandler, 0, len(d.handlers)-1)
+			cp = append(cp, d.handlers[:i]...)
+			d.handlers = append(cp, d.handlers[i+1:]...)
 			return
 		}
 	}
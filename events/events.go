@@ -27,7 +27,13 @@ func CreateService() apid.EventsService {
 	if log == nil {
 		log = apid.Log().ForModule("events")
 		config = apid.Config()
-		config.SetDefault(configChannelBufferSize, 5)
+		config.Register(apid.ConfigKey{
+			Key:         configChannelBufferSize,
+			Type:        apid.ConfigTypeInt,
+			Default:     5,
+			Description: "size of the buffer of each event selector",
+			Min:         0,
+		})
 	}
 	return &eventManager{}
 }
@@ -15,6 +15,7 @@
 package events_test
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 
@@ -87,6 +88,20 @@ var _ = Describe("Events Service", func() {
 			em.Emit("selector", &test_event{"test2"})
 		})
 
+		It("EmitContext should publish an event and report delivery", func(done Done) {
+			testEvent := &test_event{"test"}
+			h := func(event apid.Event) {
+				defer GinkgoRecover()
+				Expect(event).To(Equal(testEvent))
+			}
+			em.ListenFunc("selector", h)
+
+			ctx := apid.ContextWithRequestID(context.Background(), "request")
+			e := <-em.EmitContext(ctx, "selector", testEvent)
+			Expect(e.(apid.EventDeliveryEvent).Count).To(Equal(1))
+			close(done)
+		})
+
 		It("EmitWithCallback should call the callback when done with delivery", func(done Done) {
 			delivered := func(event apid.Event) {
 				close(done)
@@ -14,6 +14,8 @@
 
 package apid
 
+import "context"
+
 type EventSelector string
 
 type Event interface{}
@@ -30,6 +32,9 @@ type EventsService interface {
 	// Call "Emit()" for non-blocking, "<-Emit()" for blocking.
 	Emit(selector EventSelector, event Event) chan Event
 
+	// Same as Emit(), but emit and delivery are logged with the request ID carried by ctx (see ContextWithRequestID)
+	EmitContext(ctx context.Context, selector EventSelector, event Event) chan Event
+
 	// publish an event to the selector, call the passed handler when all listeners have responded to the event
 	EmitWithCallback(selector EventSelector, event Event, handler EventHandlerFunc)
 
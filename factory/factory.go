@@ -46,7 +46,9 @@ func (d *defaultServices) Data() apid.DataService {
 }
 
 func (d *defaultServices) Events() apid.EventsService {
-	return events.CreateService()
+	e := events.CreateService()
+	e.ListenFunc(apid.ConfigChangedSelector, logger.ConfigChanged)
+	return e
 }
 
 func (d *defaultServices) Log() apid.LogService {
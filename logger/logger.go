@@ -17,6 +17,9 @@ package logger
 import (
 	"fmt"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -34,6 +37,10 @@ const (
 
 var std apid.LogService
 var config apid.ConfigService
+
+// levels of the loggers by level config key, to apply level changes on config reload
+var loggers = make(map[string]*level)
+var loggersSync sync.Mutex
 var textFormatter = &logrus.TextFormatter{
 	FullTimestamp:   false,
 	TimestampFormat: time.StampMilli,
@@ -42,7 +49,13 @@ var textFormatter = &logrus.TextFormatter{
 func Base() apid.LogService {
 	if std == nil {
 		config = apid.Config()
-		config.SetDefault(ConfigLevel, defaultLevel.String())
+		config.Register(apid.ConfigKey{
+			Key:         ConfigLevel,
+			Type:        apid.ConfigTypeString,
+			Default:     defaultLevel.String(),
+			Description: "log level",
+			Enum:        levels(),
+		})
 		logLevel := config.GetString(ConfigLevel)
 		fmt.Printf("Base log level: %s\n", logLevel)
 		std = NewLogger(ConfigLevel, logLevel)
@@ -54,8 +67,24 @@ func ForModule(name string) apid.LogService {
 	return Base().ForModule(name)
 }
 
+// a log level that can be changed while logging. logrus reads Logger.Level without locking, so the logrus
+// loggers are left at DebugLevel and entries are filtered by this level instead.
+type level struct {
+	v uint32
+}
+
+func (l *level) get() logrus.Level {
+	return logrus.Level(atomic.LoadUint32(&l.v))
+}
+
+func (l *level) set(lvl logrus.Level) {
+	atomic.StoreUint32(&l.v, uint32(lvl))
+}
+
+// drops entries below its level, Fatal and Panic always log
 type logger struct {
 	*logrus.Entry
+	level *level
 }
 
 // creates new logger for module w/ appropriate log level and field
@@ -63,6 +92,12 @@ type logger struct {
 func (l *logger) ForModule(name string) apid.LogService {
 
 	configKey := fmt.Sprintf("%s_%s", name, ConfigLevel)
+	config.Register(apid.ConfigKey{
+		Key:         configKey,
+		Type:        apid.ConfigTypeString,
+		Description: fmt.Sprintf("log level of module '%s', defaults to %s", name, ConfigLevel),
+		Enum:        levels(),
+	})
 	log := NewLogger(configKey, config.GetString(configKey)).WithField(moduleField, name)
 	std.Debugf("created logger '%s' at level %s", name, log.(loggerPlus).Level())
 	return log
@@ -73,11 +108,123 @@ func (l *logger) ForEnvironment(name string) apid.LogService {
 }
 
 func (l *logger) WithField(key string, value interface{}) apid.LogService {
-	return &logger{l.Entry.WithField(key, value)}
+	return &logger{l.Entry.WithField(key, value), l.level}
 }
 
 func (l *logger) Level() logrus.Level {
-	return l.Entry.Logger.Level
+	return l.level.get()
+}
+
+func (l *logger) enabled(lvl logrus.Level) bool {
+	return l.level.get() >= lvl
+}
+
+func (l *logger) Debugf(format string, args ...interface{}) {
+	if l.enabled(logrus.DebugLevel) {
+		l.Entry.Debugf(format, args...)
+	}
+}
+
+func (l *logger) Infof(format string, args ...interface{}) {
+	if l.enabled(logrus.InfoLevel) {
+		l.Entry.Infof(format, args...)
+	}
+}
+
+func (l *logger) Printf(format string, args ...interface{}) {
+	if l.enabled(logrus.InfoLevel) {
+		l.Entry.Printf(format, args...)
+	}
+}
+
+func (l *logger) Warnf(format string, args ...interface{}) {
+	if l.enabled(logrus.WarnLevel) {
+		l.Entry.Warnf(format, args...)
+	}
+}
+
+func (l *logger) Warningf(format string, args ...interface{}) {
+	if l.enabled(logrus.WarnLevel) {
+		l.Entry.Warningf(format, args...)
+	}
+}
+
+func (l *logger) Errorf(format string, args ...interface{}) {
+	if l.enabled(logrus.ErrorLevel) {
+		l.Entry.Errorf(format, args...)
+	}
+}
+
+func (l *logger) Debug(args ...interface{}) {
+	if l.enabled(logrus.DebugLevel) {
+		l.Entry.Debug(args...)
+	}
+}
+
+func (l *logger) Info(args ...interface{}) {
+	if l.enabled(logrus.InfoLevel) {
+		l.Entry.Info(args...)
+	}
+}
+
+func (l *logger) Print(args ...interface{}) {
+	if l.enabled(logrus.InfoLevel) {
+		l.Entry.Print(args...)
+	}
+}
+
+func (l *logger) Warn(args ...interface{}) {
+	if l.enabled(logrus.WarnLevel) {
+		l.Entry.Warn(args...)
+	}
+}
+
+func (l *logger) Warning(args ...interface{}) {
+	if l.enabled(logrus.WarnLevel) {
+		l.Entry.Warning(args...)
+	}
+}
+
+func (l *logger) Error(args ...interface{}) {
+	if l.enabled(logrus.ErrorLevel) {
+		l.Entry.Error(args...)
+	}
+}
+
+func (l *logger) Debugln(args ...interface{}) {
+	if l.enabled(logrus.DebugLevel) {
+		l.Entry.Debugln(args...)
+	}
+}
+
+func (l *logger) Infoln(args ...interface{}) {
+	if l.enabled(logrus.InfoLevel) {
+		l.Entry.Infoln(args...)
+	}
+}
+
+func (l *logger) Println(args ...interface{}) {
+	if l.enabled(logrus.InfoLevel) {
+		l.Entry.Println(args...)
+	}
+}
+
+func (l *logger) Warnln(args ...interface{}) {
+	if l.enabled(logrus.WarnLevel) {
+		l.Entry.Warnln(args...)
+	}
+}
+
+func (l *logger) Warningln(args ...interface{}) {
+	if l.enabled(logrus.WarnLevel) {
+		l.Entry.Warningln(args...)
+	}
+}
+
+func (l *logger) Errorln(args ...interface{}) {
+	if l.enabled(logrus.ErrorLevel) {
+		l.Entry.Errorln(args...)
+	}
 }
 
 func NewLogger(configKey string, lvlString string) apid.LogService {
@@ -98,17 +245,70 @@ func NewLogger(configKey string, lvlString string) apid.LogService {
 		}
 	}
 
-	log := &logger{
-		logrus.NewEntry(
-			&logrus.Logger{
-				Out:       os.Stderr,
-				Formatter: textFormatter,
-				Level:     logLevel,
-			},
-		),
+	l := &logrus.Logger{
+		Out:       os.Stderr,
+		Formatter: textFormatter,
+		Level:     logrus.DebugLevel,
 	}
+	// loggers of the same key share their level
+	loggersSync.Lock()
+	key := strings.ToLower(configKey)
+	lvl := loggers[key]
+	if lvl == nil {
+		lvl = &level{}
+		loggers[key] = lvl
+	}
+	lvl.set(logLevel)
+	loggersSync.Unlock()
 
-	return log
+	return &logger{logrus.NewEntry(l), lvl}
+}
+
+// ConfigChanged is an apid.EventHandlerFunc for apid.ConfigChangedSelector that applies log level changes:
+// a changed log_level applies to the base logger and to module loggers without their own xx_log_level.
+func ConfigChanged(event apid.Event) {
+	e, ok := event.(apid.ConfigChangedEvent)
+	if !ok || config == nil {
+		return
+	}
+	changed := make(map[string]bool)
+	for _, k := range e.Keys {
+		changed[k] = true
+	}
+
+	baseLevel := defaultLevel
+	if lvl, err := logrus.ParseLevel(config.GetString(ConfigLevel)); err == nil {
+		baseLevel = lvl
+	}
+
+	loggersSync.Lock()
+	defer loggersSync.Unlock()
+	for key, lvl := range loggers {
+		lvlString := config.GetString(key)
+		if !changed[key] && !(changed[ConfigLevel] && (key == ConfigLevel || lvlString == "")) {
+			continue
+		}
+		logLevel := baseLevel
+		if lvlString != "" {
+			lvl, err := logrus.ParseLevel(lvlString)
+			if err != nil {
+				std.Warnf("invalid log level '%s' in config key: '%s'", lvlString, key)
+				continue
+			}
+			logLevel = lvl
+		}
+		std.Infof("log level for '%s' set to %s", key, logLevel)
+		lvl.set(logLevel)
+	}
+}
+
+// names accepted by logrus.ParseLevel
+func levels() []string {
+	var names []string
+	for _, l := range logrus.AllLevels {
+		names = append(names, l.String())
+	}
+	return append(names, "warn")
 }
 
 type loggerPlus interface {
@@ -0,0 +1,87 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger_test
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/apid/apid-core"
+	"github.com/apid/apid-core/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logger", func() {
+
+	type leveled interface {
+		Level() logrus.Level
+	}
+
+	setLevel := func(key, level string) {
+		apid.Config().Set(key, level)
+		logger.ConfigChanged(apid.ConfigChangedEvent{Keys: []string{key}})
+	}
+
+	It("applies a changed module level to its loggers", func() {
+		log := apid.Log().ForModule("changed")
+		other := apid.Log().ForModule("changed").WithField("field", "value")
+
+		setLevel("changed_log_level", "debug")
+		Expect(log.(leveled).Level()).To(Equal(logrus.DebugLevel))
+		Expect(other.(leveled).Level()).To(Equal(logrus.DebugLevel))
+
+		setLevel("changed_log_level", "panic")
+		Expect(log.(leveled).Level()).To(Equal(logrus.PanicLevel))
+		Expect(other.(leveled).Level()).To(Equal(logrus.PanicLevel))
+	})
+
+	It("changes the level while logging", func() {
+		log := apid.Log().ForModule("concurrent")
+		setLevel("concurrent_log_level", "panic")
+
+		var wg, started sync.WaitGroup
+		stop := make(chan struct{})
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			started.Add(1)
+			go func() {
+				defer wg.Done()
+				started.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						// filtered at the levels set below
+						log.Debugf("logging while the level changes")
+						log.WithField("field", "value").Info("logging while the level changes")
+					}
+				}
+			}()
+		}
+		started.Wait()
+		for i := 0; i < 1000; i++ {
+			if i%2 == 0 {
+				setLevel("concurrent_log_level", "fatal")
+			} else {
+				setLevel("concurrent_log_level", "panic")
+			}
+		}
+		close(stop)
+		wg.Wait()
+		Expect(log.(leveled).Level()).To(Equal(logrus.PanicLevel))
+	})
+})